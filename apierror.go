@@ -0,0 +1,151 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+	"net/http"
+	"encoding/json"
+)
+
+// ----------------------------------
+// GitHub API errors
+// ----------------------------------
+
+// GitHubRateLimit keeps the values of the X-RateLimit-* headers.
+type GitHubRateLimit struct {
+	Limit int
+	Remaining int
+	Used int
+	Reset time.Time
+	Resource string
+}
+
+// GitHubAPIError describes a failed GitHub API request.
+type GitHubAPIError struct {
+	Method string
+	Path string
+	StatusCode int
+	Status string
+	// Error description from the response body.
+	Message string
+	DocumentationURL string
+	// Nil if the response carried no rate limit headers.
+	RateLimit *GitHubRateLimit
+	// Value of the Retry-After header (secondary rate limits).
+	RetryAfter time.Duration
+	// Value of the X-GitHub-SSO header (SAML SSO enforcement).
+	SSO string
+	// Scopes of the token and scopes accepted by the endpoint (classic
+	// PATs only).
+	Scopes string
+	AcceptedScopes string
+}
+
+// NewGitHubAPIError creates the error from the response.  Body is the
+// response body.
+func NewGitHubAPIError(method, path string, resp *http.Response, body []byte) *GitHubAPIError {
+	e := &GitHubAPIError{
+		Method: method,
+		Path: path,
+		StatusCode: resp.StatusCode,
+		Status: resp.Status,
+		SSO: resp.Header.Get("X-Github-Sso"),
+		Scopes: resp.Header.Get("X-Oauth-Scopes"),
+		AcceptedScopes: resp.Header.Get("X-Accepted-Oauth-Scopes"),
+	}
+
+	var reply struct {
+		Message string           `json:"message"`
+		DocumentationURL string  `json:"documentation_url"`
+	}
+	if json.Unmarshal(body, &reply) == nil {
+		e.Message = reply.Message
+		e.DocumentationURL = reply.DocumentationURL
+	}
+
+	if s := resp.Header.Get("X-Ratelimit-Limit"); s != "" {
+		rl := &GitHubRateLimit{Resource: resp.Header.Get("X-Ratelimit-Resource")}
+		rl.Limit, _ = strconv.Atoi(s)
+		rl.Remaining, _ = strconv.Atoi(resp.Header.Get("X-Ratelimit-Remaining"))
+		rl.Used, _ = strconv.Atoi(resp.Header.Get("X-Ratelimit-Used"))
+		if n, err := strconv.ParseInt(resp.Header.Get("X-Ratelimit-Reset"), 10, 64); err == nil {
+			rl.Reset = time.Unix(n, 0)
+		}
+		e.RateLimit = rl
+	}
+	if n, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(n) * time.Second
+	}
+	return e
+}
+
+// RateLimited returns true if the request failed because of exceeded
+// rate limit.
+func (e *GitHubAPIError) RateLimited() bool {
+	if e.StatusCode != http.StatusForbidden && e.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	return e.RetryAfter > 0 || (e.RateLimit != nil && e.RateLimit.Remaining == 0)
+}
+
+// Error returns the description of the error.  The first line describes
+// the request and the status, subsequent indented lines give details.
+func (e *GitHubAPIError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s: %s", e.Method, e.Path, e.Status)
+	if e.Message != "" {
+		fmt.Fprintf(&sb, ": %s", e.Message)
+	}
+
+	var details []string
+	switch {
+	case e.RateLimited():
+		if e.RetryAfter > 0 {
+			details = append(details, fmt.Sprintf("secondary rate limit exceeded; retry after %s", e.RetryAfter))
+		} else {
+			rl := e.RateLimit
+			details = append(details, fmt.Sprintf("rate limit exceeded (%d requests for %s); resets at %s (in %s)",
+				rl.Limit, rl.Resource, rl.Reset.Local().Format("15:04:05"),
+				time.Until(rl.Reset).Truncate(time.Second)))
+		}
+	case e.SSO != "":
+		msg := "token must be authorized for use with SAML single sign-on"
+		if n := strings.Index(e.SSO, "url="); n != -1 {
+			msg += "; visit " + e.SSO[n+4:]
+		}
+		details = append(details, msg)
+	case e.StatusCode == http.StatusUnauthorized:
+		details = append(details, "token is invalid, expired or revoked")
+	case e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusNotFound:
+		if e.AcceptedScopes != "" {
+			details = append(details, fmt.Sprintf("token scopes: %s; accepted scopes: %s", orNone(e.Scopes), e.AcceptedScopes))
+		} else if e.StatusCode == http.StatusNotFound {
+			details = append(details, "entity does not exist or token lacks access to it")
+		}
+	}
+	if e.RateLimit != nil && !e.RateLimited() && e.RateLimit.Limit > 0 && e.RateLimit.Remaining * 10 < e.RateLimit.Limit {
+		details = append(details, fmt.Sprintf("rate limit: %d of %d requests remaining", e.RateLimit.Remaining, e.RateLimit.Limit))
+	}
+	if e.DocumentationURL != "" {
+		details = append(details, "see " + e.DocumentationURL)
+	}
+	for _, d := range details {
+		sb.WriteString("\n  ")
+		sb.WriteString(d)
+	}
+	return sb.String()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
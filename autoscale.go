@@ -0,0 +1,297 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"log"
+	"time"
+	"sort"
+	"strings"
+	"strconv"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Queue-driven autoscaler
+// ----------------------------------
+
+// Returns true if every label requested by the job is provided by the
+// runner.
+func jobMatchesLabels(job GHWorkflowJob, labels []string) bool {
+	for _, jl := range job.Labels {
+		found := false
+		for _, rl := range labels {
+			if strings.EqualFold(jl, rl) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Repositories of an organization, as last obtained from GitHub.
+type orgReposEntry struct {
+	repos []string
+	time time.Time
+}
+
+// Cache of organization repositories, indexed by entity key.  Listing all
+// repositories on each poll would quickly exhaust the API rate limit.
+var orgReposCache = make(map[string]orgReposEntry)
+
+// Returns the repositories of the organization, refreshing the cached list
+// when it is older than autoscale_repos_refresh.
+func autoscaleOrgRepos(ent entityValue, pat string) ([]string, error) {
+	key := ent.HostKey()
+	if e, ok := orgReposCache[key]; ok && time.Since(e.time) < config.AutoscaleReposRefresh {
+		return e.repos, nil
+	}
+	repos, err := GitHubOrgRepos(ent.Namespace(), ent.Name, pat)
+	if err != nil {
+		return nil, err
+	}
+	orgReposCache[key] = orgReposEntry{repos: repos, time: time.Now()}
+	return repos, nil
+}
+
+// Returns the number of queued jobs that can be run by the runners of
+// the entity.
+func autoscaleQueuedJobs(ent entityValue, ac *AutoscaleConfig, pat string) (int, error) {
+	var repos []string
+	switch ent.Type {
+	case EntityRepo:
+		repos = []string{ent.Name}
+	case EntityOrg:
+		repos = ac.Repos
+		if len(repos) == 0 {
+			var err error
+			if repos, err = autoscaleOrgRepos(ent, pat); err != nil {
+				return 0, err
+			}
+		}
+	default:
+		repos = ac.Repos
+	}
+
+	labels := defaultRunnerLabels()
+	if ac.Labels != "" {
+		labels = append(labels, strings.Split(ac.Labels, ",")...)
+	}
+
+	count := 0
+	for _, repo := range repos {
+		jobs, err := GitHubQueuedJobs(ent.Namespace(), repo, pat)
+		if err != nil {
+			return 0, err
+		}
+		for _, job := range jobs {
+			if jobMatchesLabels(job, labels) {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// AutoscaleEntity adjusts the number of runners of the entity to the
+// number of queued jobs.  Returns true if pc was modified.
+func AutoscaleEntity(ent entityValue, ac *AutoscaleConfig, pc *PiesConfig) (bool, error) {
+	pat, err := GetToken(ent.PATKey())
+	if err != nil {
+		return false, err
+	}
+
+	queued, err := autoscaleQueuedJobs(ent, ac, pat)
+	if err != nil {
+		return false, err
+	}
+
+	ghRunners, err := GitHubListRunners(ent, pat)
+	if err != nil {
+		return false, err
+	}
+	byName := make(map[string]GHRunner)
+	for _, r := range ghRunners {
+		byName[r.Name] = r
+	}
+
+	key := ent.BaseKey()
+	local := pc.Runners[key]
+	busy := 0
+	var idle []int
+	for _, r := range local {
+		name, err := RegisteredRunnerName(r.Dir, filepath.Join(key, strconv.Itoa(r.Num)))
+		if err != nil {
+			return false, err
+		}
+		// Runners not known to GitHub are being registered: they are
+		// neither busy nor idle.
+		if gr, ok := byName[name]; ok {
+			if gr.Busy {
+				busy++
+			} else {
+				idle = append(idle, r.Num)
+			}
+		}
+	}
+
+	desired := busy + queued
+	if desired < ac.Min {
+		desired = ac.Min
+	}
+	if desired > ac.Max {
+		desired = ac.Max
+	}
+	current := len(local)
+	log.Printf("%s: %d runners (%d busy, %d idle), %d queued jobs, desired %d", key, current, busy, len(idle), queued, desired)
+
+	switch {
+	case desired > current:
+		log.Printf("%s: adding %d runners", key, desired - current)
+		results, err := AddRunners(ent, pc, AddOptions{
+			Labels: ac.Labels,
+			RunnerGroup: ac.RunnerGroup,
+			Ephemeral: ac.Ephemeral,
+			Count: desired - current,
+			Jobs: 4,
+		})
+		if err != nil {
+			return false, err
+		}
+		added := 0
+		for _, res := range results {
+			if res.Err == nil {
+				added++
+			} else {
+				log.Printf("%s: %v", res.Name, res.Err)
+			}
+		}
+		return added > 0, err
+
+	case desired < current:
+		n := current - desired
+		if n > len(idle) {
+			n = len(idle)
+		}
+		if n == 0 {
+			return false, nil
+		}
+		// Remove idle runners with highest ordinals first
+		sort.Sort(sort.Reverse(sort.IntSlice(idle)))
+		log.Printf("%s: removing %d idle runners", key, n)
+		var opts DeleteOptions
+		removed := 0
+		for _, num := range idle[:n] {
+			if err := DeleteRunner(ent, pc, num, &opts); err != nil {
+				return removed > 0, err
+			}
+			removed++
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func AutoscaleAction(args []string) {
+	ReadConfig()
+	FinalizeConfig()
+	optset := NewOptset(args)
+	optset.SetParameters("")
+	var (
+		once bool
+		interval = config.AutoscaleInterval
+		cooldown = config.AutoscaleCooldown
+	)
+	optset.FlagLong(&once, "once", '1', "Run a single iteration and exit")
+	optset.FlagLong(&interval, "interval", 'i', "Polling interval", "DURATION")
+	optset.FlagLong(&cooldown, "cooldown", 'c', "Minimal interval between scaling operations on the same entity", "DURATION")
+	optset.Parse()
+
+	if len(optset.Args()) != 0 {
+		log.Fatalf("too many arguments; try `%s --help' for assistance", optset.Command)
+	}
+
+	if !VerifyStruct(&config, false) {
+		log.Fatalf("configuration fails sanity checking; run `%s configcheck' for more info", os.Args[0])
+	}
+
+	type autoscaleEntry struct {
+		ent entityValue
+		ac *AutoscaleConfig
+	}
+	var entries []autoscaleEntry
+	for key, ec := range config.Entities {
+		if ec == nil || ec.Autoscale == nil {
+			continue
+		}
+		ent, _ := ParseEntityKey(key)
+		entries = append(entries, autoscaleEntry{ent: ent, ac: ec.Autoscale})
+	}
+	if len(entries) == 0 {
+		log.Fatal("no entities configured for autoscaling")
+	}
+	sort.Slice(entries, func (i, j int) bool { return entries[i].ent.BaseKey() < entries[j].ent.BaseKey() })
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+
+	lastChange := make(map[string]time.Time)
+	for {
+		// Don't hold the lock between iterations
+		lock, err := LockRoot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		pc, err := ParsePiesConfig(config.PiesConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		modified := false
+		for _, e := range entries {
+			key := e.ent.BaseKey()
+			if t, ok := lastChange[key]; ok && time.Since(t) < cooldown {
+				continue
+			}
+			changed, err := AutoscaleEntity(e.ent, e.ac, pc)
+			if err != nil {
+				log.Printf("%s: %v", key, err)
+			}
+			if changed {
+				lastChange[key] = time.Now()
+				modified = true
+			}
+		}
+
+		if modified {
+			if err := pc.Save(); err != nil {
+				log.Fatal(err)
+			}
+			if err := PiesReloadConfig(pc.ControlURL); err != nil {
+				log.Printf("Pies configuration updated, but pies not reloaded: %v", err)
+			}
+		}
+		lock.Unlock()
+
+		if once {
+			break
+		}
+
+		select {
+		case <-time.After(interval):
+		case sig := <-sigchan:
+			log.Printf("got %s, exiting", sig)
+			return
+		}
+	}
+}
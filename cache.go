@@ -0,0 +1,304 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"strconv"
+	"regexp"
+	"path/filepath"
+	"golang.org/x/mod/semver"
+)
+
+// ----------------------------------
+// Runner archive cache
+// ----------------------------------
+
+// Name of the file in the runner directory that keeps the name of the
+// archive the runner was extracted from.
+const ArchiveMarkerFile = `.ghb-archive`
+
+var archiveNameRx = regexp.MustCompile(`^actions-runner-([a-z]+)-([a-z0-9]+)-(\d+\.\d+\.\d+)\.tar\.gz$`)
+
+type CachedArchive struct {
+	FileName string
+	OS string
+	Arch string
+	Version string
+}
+
+func (arc CachedArchive) Path() string {
+	return filepath.Join(config.CacheDir, arc.FileName)
+}
+
+// Compares versions of two archives.
+func (arc CachedArchive) Compare(other CachedArchive) int {
+	return semver.Compare(`v` + arc.Version, `v` + other.Version)
+}
+
+func ArchiveName(osname, arch, version string) string {
+	return fmt.Sprintf("actions-runner-%s-%s-%s.tar.gz", osname, arch, version)
+}
+
+// ParseArchiveName extracts OS, architecture and version from the runner
+// archive file name.
+func ParseArchiveName(name string) (arc CachedArchive, err error) {
+	if m := archiveNameRx.FindStringSubmatch(name); m != nil {
+		arc = CachedArchive{FileName: name, OS: m[1], Arch: m[2], Version: m[3]}
+	} else {
+		err = fmt.Errorf("%s: not a runner archive name", name)
+	}
+	return
+}
+
+// ListCachedArchives returns the list of runner archives in the cache,
+// sorted by OS, architecture and version (newest first).
+func ListCachedArchives() ([]CachedArchive, error) {
+	files, err := ioutil.ReadDir(config.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	var result []CachedArchive
+	for _, f := range files {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if arc, err := ParseArchiveName(f.Name()); err == nil {
+			result = append(result, arc)
+		}
+	}
+	sort.Slice(result, func (i, j int) bool {
+		if result[i].OS != result[j].OS {
+			return result[i].OS < result[j].OS
+		}
+		if result[i].Arch != result[j].Arch {
+			return result[i].Arch < result[j].Arch
+		}
+		return result[i].Compare(result[j]) > 0
+	})
+	return result, nil
+}
+
+// NewestCachedArchive returns the newest cached archive for the given OS
+// and architecture.
+func NewestCachedArchive(osname, arch string) (CachedArchive, error) {
+	archives, err := ListCachedArchives()
+	if err != nil {
+		return CachedArchive{}, err
+	}
+	for _, arc := range archives {
+		if arc.OS == osname && arc.Arch == arch {
+			return arc, nil
+		}
+	}
+	return CachedArchive{}, fmt.Errorf("no cached runner archive for %s %s", osname, arch)
+}
+
+// WriteArchiveMarker records the name of the archive the runner in
+// dirname was extracted from.
+func WriteArchiveMarker(dirname, arc string) error {
+	filename := filepath.Join(dirname, ArchiveMarkerFile)
+	if err := ioutil.WriteFile(filename, []byte(filepath.Base(arc) + "\n"), 0640); err != nil {
+		return fmt.Errorf("can't write %s: %v", filename, err)
+	}
+	return nil
+}
+
+// RunnerArchive returns the name of the archive the runner in dirname
+// was extracted from.
+func RunnerArchive(dirname string) (string, error) {
+	if b, err := ioutil.ReadFile(filepath.Join(dirname, ArchiveMarkerFile)); err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	// Runner installed before the marker was introduced
+	version, err := RunnerVersion(dirname)
+	if err != nil {
+		return "", err
+	}
+	osname, arch := HostPlatform()
+	return ArchiveName(osname, arch, version), nil
+}
+
+// Returns a map of archive names to the lists of runners using them.
+func archiveUsers(pc *PiesConfig) map[string][]string {
+	users := make(map[string][]string)
+	for key, runners := range pc.Runners {
+		for _, r := range runners {
+			if name, err := RunnerArchive(r.Dir); err == nil {
+				users[name] = append(users[name], filepath.Join(key, strconv.Itoa(r.Num)))
+			}
+		}
+	}
+	for _, u := range users {
+		sort.Strings(u)
+	}
+	return users
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst) + `.*`)
+	if err != nil {
+		return err
+	}
+	tempname := out.Name()
+	defer os.Remove(tempname)
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempname, dst)
+}
+
+func cacheList(pc *PiesConfig) {
+	archives, err := ListCachedArchives()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users := archiveUsers(pc)
+	for _, arc := range archives {
+		fmt.Printf("%-10s %-6s %-6s %s\n", arc.Version, arc.OS, arc.Arch, arc.FileName)
+		for _, u := range users[arc.FileName] {
+			fmt.Printf("    %s\n", u)
+		}
+	}
+}
+
+func cachePrune(pc *PiesConfig, keep int, dryRun bool) {
+	archives, err := ListCachedArchives()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users := archiveUsers(pc)
+	count := make(map[string]int)
+	for _, arc := range archives {
+		platform := arc.OS + "-" + arc.Arch
+		count[platform]++
+		if count[platform] <= keep {
+			continue
+		}
+		if len(users[arc.FileName]) > 0 {
+			fmt.Printf("Keeping %s: used by %d runners\n", arc.FileName, len(users[arc.FileName]))
+			continue
+		}
+		fmt.Printf("Removing %s\n", arc.FileName)
+		if !dryRun {
+			if err := os.Remove(arc.Path()); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+func cacheImport(filename, osname, arch, version, checksum string) {
+	name := filepath.Base(filename)
+	if _, err := ParseArchiveName(name); err != nil {
+		if version == "" {
+			log.Fatalf("%v; use --version to supply the runner version", err)
+		}
+		name = ArchiveName(osname, arch, version)
+	}
+	if err := VerifyChecksum(filename, checksum); err != nil {
+		log.Fatal(err)
+	}
+	dst := filepath.Join(config.CacheDir, name)
+	if err := copyFile(dst, filename); err != nil {
+		log.Fatalf("can't import %s: %v", filename, err)
+	}
+	fmt.Printf("Imported %s as %s\n", filename, dst)
+}
+
+func CacheAction(args []string) {
+	ReadConfig()
+	FinalizeConfig()
+	optset := NewEntityOptset(args)
+	optset.SetParameters("list|prune|fetch|import [ARGS]")
+	osname, arch := HostPlatform()
+	var (
+		keep = 2
+		dryRun bool
+		version string
+		checksum string
+	)
+	optset.FlagLong(&keep, "keep", 'k', "Number of versions to keep (with prune)", "N")
+	optset.FlagLong(&dryRun, "dry-run", 'n', "Don't remove anything (with prune)")
+	optset.FlagLong(&osname, "os", 0, "Runner OS (with fetch and import)", "NAME")
+	optset.FlagLong(&arch, "arch", 0, "Runner architecture (with fetch and import)", "NAME")
+	optset.FlagLong(&version, "version", 0, "Runner version (with import)", "VERSION")
+	optset.FlagLong(&checksum, "sha256", 0, "Expected SHA-256 checksum (with import)", "HEX")
+	// Entity is needed only for fetch
+	optset.Optset.Parse()
+
+	args = optset.Args()
+	if len(args) == 0 {
+		log.Fatalf("subcommand missing; try `%s --help' for assistance", optset.Command)
+	}
+
+	if args[0] != `list` {
+		lock, err := LockRoot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer lock.Unlock()
+	}
+
+	switch args[0] {
+	case `list`, `prune`:
+		if len(args) != 1 {
+			log.Fatalf("too many arguments; try `%s --help' for assistance", optset.Command)
+		}
+		pc, err := ParsePiesConfig(config.PiesConfigFile)
+		if err != nil {
+			log.Panic(err)
+		}
+		if args[0] == `list` {
+			cacheList(pc)
+		} else {
+			if keep < 1 {
+				log.Fatal("--keep must be a positive number")
+			}
+			cachePrune(pc, keep, dryRun)
+		}
+
+	case `fetch`:
+		if len(args) != 1 {
+			log.Fatalf("too many arguments; try `%s --help' for assistance", optset.Command)
+		}
+		if optset.Entity.Name == "" {
+			log.Fatal("One of --org, --enterprise, or --repo must be given")
+		}
+		dn, err := GitHubSelectPlatformDownload(optset.Entity, osname, arch)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := FetchArchive(dn); err != nil {
+			log.Fatal(err)
+		}
+
+	case `import`:
+		if len(args) != 2 {
+			log.Fatalf("import requires exactly one argument; try `%s --help' for assistance", optset.Command)
+		}
+		cacheImport(args[1], osname, arch, version, checksum)
+
+	default:
+		log.Fatalf("unrecognized subcommand; try `%s --help' for assistance", optset.Command)
+	}
+}
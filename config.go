@@ -18,25 +18,185 @@ import (
 	"reflect"
 	"text/template"
 	"strings"
+	"strconv"
+	"time"
+	"net/url"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
 	RootDir string            `yaml:"root_dir" rem:"Root directory" verify:"dir_exist"`
+	GitHubURL string          `yaml:"github_url,omitempty" rem:"GitHub web base URL" verify:"url"`
+	GitHubAPIURL string       `yaml:"github_api_url,omitempty" rem:"GitHub API base URL (default: derived from github_url)" verify:"url"`
 	RunnersDir string         `yaml:"runners_dir" rem:"Directory for storing runners" verify:"dir_exist"  rel:"RootDir"`
 	CacheDir string           `yaml:"cache_dir" rem:"Cache directory" verify:"dir_exist" rel:"RootDir"`
-	Tar string                `yaml:"tar" rem:"Tar binary" verify:"exe"`
+	Tar string                `yaml:"tar" rem:"Tar binary (empty to use built-in extractor)" verify:"opt_exe"`
 	Pies string               `yaml:"pies" rem:"Pies binary" verify:"pies_version"`
 	PiesConfigFile string     `yaml:"pies_config_file" rem:"Pies configuration file name" verify:"pies_config" rel:"RootDir"`
 	ComponentTemplate string  `yaml:"component_template" rem:"Template for runner components" verify:"component_template"`
+	EphemeralComponentTemplate string `yaml:"ephemeral_component_template" rem:"Template for ephemeral runner components" verify:"component_template"`
+	RunnerNameTemplate string `yaml:"runner_name_template" rem:"Template for runner names" verify:"runner_name_template"`
+	AutoscaleInterval time.Duration `yaml:"autoscale_interval" rem:"Interval between two successive autoscaler polls"`
+	AutoscaleCooldown time.Duration `yaml:"autoscale_cooldown" rem:"Minimal interval between two scaling operations on the same entity"`
+	AutoscaleReposRefresh time.Duration `yaml:"autoscale_repos_refresh" rem:"Interval between two successive scans of organization repositories by the autoscaler"`
+	JobStartedHook string     `yaml:"job_started_hook,omitempty" rem:"Script to run before each job" verify:"hook"`
+	JobCompletedHook string   `yaml:"job_completed_hook,omitempty" rem:"Script to run after each job" verify:"hook"`
+	TokenStore string         `yaml:"token_store,omitempty" rem:"Token store backend" verify:"token_store"`
+	TokenHelper string        `yaml:"token_helper,omitempty" rem:"Credential helper program for the helper token store"`
+	TokenPassphrase string    `yaml:"token_passphrase,omitempty" rem:"Passphrase for token database encryption"`
+	TokenKeyFile string       `yaml:"token_key_file,omitempty" rem:"Key file for token database encryption" rel:"RootDir"`
+	TokenExpiryWarning time.Duration `yaml:"token_expiry_warning" rem:"Warn about PATs expiring within this interval"`
+	Retention RetentionConfig `yaml:"retention" rem:"Retention policy for runner work directories"`
+	HTTP HTTPConfig           `yaml:"http" rem:"HTTP client settings" verify:"http"`
+	Entities map[string]*EntityConfig `yaml:"entities,omitempty" rem:"Per-entity settings" verify:"entities"`
+}
+
+// Per-entity settings.  Entities are identified by their base keys,
+// e.g. "/orgs/foo" or "/repos/foo/bar".
+type EntityConfig struct {
+	Autoscale *AutoscaleConfig  `yaml:"autoscale,omitempty"`
+	JobStartedHook string       `yaml:"job_started_hook,omitempty"`
+	JobCompletedHook string     `yaml:"job_completed_hook,omitempty"`
+	Env map[string]string       `yaml:"env,omitempty"`
+	App *GitHubAppConfig        `yaml:"app,omitempty"`
+	GitHubURL string            `yaml:"github_url,omitempty"`
+	GitHubAPIURL string         `yaml:"github_api_url,omitempty"`
+}
+
+// GitHub App credentials.
+type GitHubAppConfig struct {
+	AppID int64             `yaml:"app_id"`
+	InstallationID int64    `yaml:"installation_id"`
+	PrivateKeyFile string   `yaml:"private_key_file"`
+}
+
+// EntityConfig returns the settings for the entity, or nil if there are
+// none.
+func (cfg *Config) EntityConfig(ent entityValue) *EntityConfig {
+	return cfg.Entities[ent.BaseKey()]
+}
+
+type AutoscaleConfig struct {
+	Min int                 `yaml:"min"`
+	Max int                 `yaml:"max"`
+	Labels string           `yaml:"labels,omitempty"`
+	RunnerGroup string      `yaml:"runnergroup,omitempty"`
+	Ephemeral bool          `yaml:"ephemeral,omitempty"`
+	Repos []string          `yaml:"repos,omitempty"`
+}
+
+// Retention policy for runner work directories.  Zero values disable the
+// corresponding limits.
+type RetentionConfig struct {
+	MaxSize ByteSize        `yaml:"max_size"`
+	MaxAge time.Duration    `yaml:"max_age"`
+	MinFree ByteSize        `yaml:"min_free"`
+}
+
+func (rc RetentionConfig) IsZero() bool {
+	return rc.MaxSize == 0 && rc.MaxAge == 0 && rc.MinFree == 0
+}
+
+// ByteSize is a size in bytes.  In the configuration file, it can be
+// given as a number optionally followed by one of the suffixes K, M, G
+// or T (powers of 1024).
+type ByteSize int64
+
+var byteSizeSuffixes = "KMGT"
+
+func ParseByteSize(s string) (ByteSize, error) {
+	str := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s), "B"), "i")
+	mul := int64(1)
+	if n := len(str); n > 0 {
+		if i := strings.IndexByte(byteSizeSuffixes, strings.ToUpper(str)[n-1]); i != -1 {
+			mul <<= 10 * uint(i + 1)
+			str = str[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%q: invalid size", s)
+	}
+	return ByteSize(f * float64(mul)), nil
+}
+
+func (b ByteSize) String() string {
+	for i := len(byteSizeSuffixes) - 1; i >= 0; i-- {
+		unit := int64(1) << (10 * uint(i + 1))
+		if int64(b) >= unit {
+			if int64(b) % unit == 0 {
+				return fmt.Sprintf("%d%c", int64(b) / unit, byteSizeSuffixes[i])
+			}
+			return fmt.Sprintf("%.1f%c", float64(b) / float64(unit), byteSizeSuffixes[i])
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
+
+// Base URLs must be absolute HTTP(S) URLs.
+func checkBaseURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != `https` && u.Scheme != `http`) || u.Host == "" {
+		return fmt.Errorf("%s: expected absolute http or https URL", s)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%s: base URL can't have query or fragment", s)
+	}
+	return nil
+}
+
+// Job hooks are run by the runner, which requires absolute file names.
+func checkHook(filename string) error {
+	if filename == "" {
+		return nil
+	}
+	if !filepath.IsAbs(filename) {
+		return fmt.Errorf("%s: hook file name must be absolute", filename)
+	}
+	st, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", filename)
+	}
+	return nil
 }
 
 var config = Config{
 	RunnersDir: ``,
 	CacheDir: ``,
-	Tar: `tar`,
+	Tar: ``,
 	Pies: `pies`,
 	PiesConfigFile: ``,
+	RunnerNameTemplate: `{{ Hostname }}_{{ Slug EntityName }}_{{ Ordinal }}`,
+	AutoscaleInterval: time.Minute,
+	AutoscaleCooldown: 5 * time.Minute,
+	AutoscaleReposRefresh: time.Hour,
+	TokenExpiryWarning: 7 * 24 * time.Hour,
 	// FIXME: Make sure the lines in the literal below are indented using spaces, not tabs.
 	// This way yaml marshaller prints the value in readable form.
         ComponentTemplate: `component "{{ RunnerName }}" {
@@ -47,6 +207,15 @@ var config = Config{
         flags siggroup;
         command "./run.sh";
 }
+`,
+        EphemeralComponentTemplate: `component "{{ RunnerName }}" {
+        mode respawn;
+        chdir "{{ Config.RunnersDir }}/{{ RunnerName }}";
+        stderr syslog daemon.err;
+        stdout syslog daemon.info;
+        flags siggroup;
+        command "{{ Ghb }} ephemeral {{ RunnerName }}";
+}
 `,
 }
 
@@ -140,6 +309,20 @@ func ReadConfig() (ok bool, filename string) {
 	if !filepath.IsAbs(config.PiesConfigFile) {
 		config.PiesConfigFile = filepath.Join(config.RootDir, config.PiesConfigFile)
 	}
+
+	if config.TokenKeyFile != "" && !filepath.IsAbs(config.TokenKeyFile) {
+		config.TokenKeyFile = filepath.Join(config.RootDir, config.TokenKeyFile)
+	}
+	for _, p := range []*string{&config.HTTP.CAFile, &config.HTTP.ClientCert, &config.HTTP.ClientKey} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(config.RootDir, *p)
+		}
+	}
+	for _, ec := range config.Entities {
+		if ec != nil && ec.App != nil && ec.App.PrivateKeyFile != "" && !filepath.IsAbs(ec.App.PrivateKeyFile) {
+			ec.App.PrivateKeyFile = filepath.Join(config.RootDir, ec.App.PrivateKeyFile)
+		}
+	}
 	return
 }
 
@@ -164,6 +347,42 @@ func VerifyStruct(obj interface{}, verbose bool) (result bool) {
 			cmd.Stderr = nil
 			return cmd.Run()
 		},
+		"opt_exe": func(v reflect.Value) error {
+			exe, _ := v.Interface().(string)
+			if exe == "" {
+				return nil
+			}
+			cmd := exec.Command(exe, "--version")
+			cmd.Stdout = nil
+			cmd.Stderr = nil
+			return cmd.Run()
+		},
+		"token_store": func(v reflect.Value) error {
+			name, _ := v.Interface().(string)
+			if name == "" {
+				return nil
+			}
+			if _, ok := tokenStores[name]; !ok {
+				return fmt.Errorf("unknown token store %q; available stores: %s", name, strings.Join(TokenStoreNames(), ", "))
+			}
+			if name == `helper` && config.TokenHelper == "" {
+				return errors.New("token_helper must be set")
+			}
+			return nil
+		},
+		"url": func(v reflect.Value) error {
+			s, _ := v.Interface().(string)
+			return checkBaseURL(s)
+		},
+		"http": func(v reflect.Value) error {
+			hc, _ := v.Interface().(HTTPConfig)
+			_, err := hc.Transport()
+			return err
+		},
+		"hook": func(v reflect.Value) error {
+			filename, _ := v.Interface().(string)
+			return checkHook(filename)
+		},
 		"pies_version": func(v reflect.Value) error {
 			exe, _ := v.Interface().(string)
 			return CheckPiesCommand(exe)
@@ -186,6 +405,53 @@ func VerifyStruct(obj interface{}, verbose bool) (result bool) {
 			}
 			return nil
 		},
+		"runner_name_template": func(v reflect.Value) error {
+			_, err := RunnerName("/repos/owner/repo/0", nil)
+			return err
+		},
+		"entities": func(v reflect.Value) error {
+			entities, _ := v.Interface().(map[string]*EntityConfig)
+			for key, ec := range entities {
+				if _, err := ParseEntityKey(key); err != nil {
+					return err
+				}
+				if ec == nil {
+					continue
+				}
+				for name, value := range ec.Env {
+					if err := CheckEnvVariable(name, value); err != nil {
+						return fmt.Errorf("%s: %v", key, err)
+					}
+				}
+				for _, u := range []string{ec.GitHubURL, ec.GitHubAPIURL} {
+					if err := checkBaseURL(u); err != nil {
+						return fmt.Errorf("%s: %v", key, err)
+					}
+				}
+				for _, hook := range []string{ec.JobStartedHook, ec.JobCompletedHook} {
+					if err := checkHook(hook); err != nil {
+						return fmt.Errorf("%s: %v", key, err)
+					}
+				}
+				if app := ec.App; app != nil {
+					if app.AppID == 0 || app.InstallationID == 0 || app.PrivateKeyFile == "" {
+						return fmt.Errorf("%s: app_id, installation_id and private_key_file must be set", key)
+					}
+					if _, err := readAppPrivateKey(app.PrivateKeyFile); err != nil {
+						return fmt.Errorf("%s: %v", key, err)
+					}
+				}
+				if ac := ec.Autoscale; ac != nil {
+					if ac.Min < 0 || ac.Max < 1 || ac.Min > ac.Max {
+						return fmt.Errorf("%s: bad autoscale bounds", key)
+					}
+					if ent, _ := ParseEntityKey(key); ent.Type == EntityEnterprise && len(ac.Repos) == 0 {
+						return fmt.Errorf("%s: autoscale requires repos for enterprises", key)
+					}
+				}
+			}
+			return checkAPIURLs()
+		},
 		"component_template": func(v reflect.Value) error {
 			text, _ := v.Interface().(string)
 			_, err := ExpandTemplate(text, "runner_0");
@@ -296,7 +562,7 @@ func NormalizeRel(obj interface{}) {
 		v = v.Elem()
 	}
 	if v.Kind() != reflect.Struct {
-		log.Panic("Passed object has unsupported type: %s", v.Kind())
+		log.Panicf("Passed object has unsupported type: %s", v.Kind())
 	}
 	t := v.Type()
 	for i := 0; i < v.NumField(); i++ {
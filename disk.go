@@ -0,0 +1,437 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+	"errors"
+	"strconv"
+	"syscall"
+	"io/fs"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Disk usage and work directory cleanup
+// ----------------------------------
+
+// Name of the runner work directory.
+const RunnerWorkDir = `_work`
+
+// DiskUsage returns the disk space used by the files under path and the
+// most recent modification time among them.
+func DiskUsage(path string) (size int64, newest time.Time, err error) {
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		st, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+			size += int64(sys.Blocks) * 512
+		} else {
+			size += st.Size()
+		}
+		if st.ModTime().After(newest) {
+			newest = st.ModTime()
+		}
+		return nil
+	})
+	return
+}
+
+// FreeSpace returns the space available to unprivileged users on the
+// file system containing path.
+func FreeSpace(path string) (ByteSize, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return ByteSize(int64(st.Bavail) * int64(st.Bsize)), nil
+}
+
+// WorkEntry describes a top-level entry in the runner work directory.
+type WorkEntry struct {
+	Path string
+	Size int64
+	ModTime time.Time
+}
+
+// ScanWorkDir returns the entries of the work directory of the runner,
+// oldest first.
+func ScanWorkDir(dirname string) ([]WorkEntry, error) {
+	workdir := filepath.Join(dirname, RunnerWorkDir)
+	dir, err := os.ReadDir(workdir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []WorkEntry
+	for _, de := range dir {
+		path := filepath.Join(workdir, de.Name())
+		size, newest, err := DiskUsage(path)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, WorkEntry{Path: path, Size: size, ModTime: newest})
+	}
+	sort.Slice(result, func (i, j int) bool { return result[i].ModTime.Before(result[j].ModTime) })
+	return result, nil
+}
+
+func DuAction(args []string) {
+	ReadConfig()
+	optset := NewEntityOptset(args)
+	optset.SetParameters("")
+	summary := false
+	optset.FlagLong(&summary, "summary", 's', "Display only per-entity totals")
+	// Entity is optional: don't call optset.Parse
+	optset.Optset.Parse()
+
+	if len(optset.Args()) != 0 {
+		log.Fatalf("too many arguments; try `%s --help' for assistance", optset.Command)
+	}
+
+	pc, err := ParsePiesConfig(config.PiesConfigFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var keys []string
+	if optset.Entity.Name != "" {
+		keys = append(keys, optset.Entity.BaseKey())
+		if _, ok := pc.Runners[keys[0]]; !ok {
+			log.Fatalf("found no runners for %s", keys[0])
+		}
+	} else {
+		for key := range pc.Runners {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	fmt.Printf("%-40.40s %8s %8s\n", "RUNNER", "SIZE", "WORK")
+	var total, totalWork int64
+	for _, key := range keys {
+		var entSize, entWork int64
+		for _, r := range pc.Runners[key] {
+			size, _, err := DiskUsage(r.Dir)
+			if err != nil {
+				log.Fatal(err)
+			}
+			work, _, err := DiskUsage(filepath.Join(r.Dir, RunnerWorkDir))
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !summary {
+				fmt.Printf("%-40.40s %8s %8s\n", filepath.Join(key, strconv.Itoa(r.Num)), ByteSize(size), ByteSize(work))
+			}
+			entSize += size
+			entWork += work
+		}
+		fmt.Printf("%-40.40s %8s %8s\n", key, ByteSize(entSize), ByteSize(entWork))
+		total += entSize
+		totalWork += entWork
+	}
+	fmt.Printf("%-40.40s %8s %8s\n", "total", ByteSize(total), ByteSize(totalWork))
+
+	if free, err := FreeSpace(config.RunnersDir); err == nil {
+		fmt.Printf("Free space in %s: %s\n", config.RunnersDir, free)
+	} else {
+		log.Printf("can't get free space in %s: %v", config.RunnersDir, err)
+	}
+}
+
+// Runner considered for cleanup.
+type cleanCandidate struct {
+	Name string
+	Ent entityValue
+	// PAT for checking whether the runner is busy.  Empty if the
+	// runner is not running.
+	PAT string
+	Running bool
+	Entries []WorkEntry
+	Remove []WorkEntry
+}
+
+// Returns true if the runner can be cleaned.  A runner that is not running
+// is always idle.  A running one is idle if GitHub reports it as not busy.
+func runnerIsIdle(status string, r Runner, name string, ghRunners map[string]GHRunner) (bool, error) {
+	if status != `running` {
+		return true, nil
+	}
+	if ghRunners == nil {
+		return false, errors.New("no PAT: can't determine whether the runner is busy")
+	}
+	regName, err := RegisteredRunnerName(r.Dir, name)
+	if err != nil {
+		return false, err
+	}
+	gr, ok := ghRunners[regName]
+	if !ok {
+		return false, errors.New("runner not registered at GitHub")
+	}
+	return !gr.Busy, nil
+}
+
+// Returns idle runners of the entity.
+func cleanCandidates(key string, pc *PiesConfig) ([]*cleanCandidate, error) {
+	ent, err := ParseEntityKey(key)
+	if err != nil {
+		return nil, err
+	}
+	var ghRunners map[string]GHRunner
+	pat, err := GetToken(ent.PATKey())
+	if err == nil {
+		list, err := GitHubListRunners(ent, pat)
+		if err != nil {
+			return nil, err
+		}
+		ghRunners = make(map[string]GHRunner)
+		for _, gr := range list {
+			ghRunners[gr.Name] = gr
+		}
+	} else if !errors.Is(err, ErrTokenNotFound) {
+		return nil, err
+	}
+
+	var result []*cleanCandidate
+	for _, r := range pc.Runners[key] {
+		name := filepath.Join(key, strconv.Itoa(r.Num))
+		status, err := GetPiesComponentStatus(pc.ControlURL, name)
+		if err != nil {
+			log.Printf("%s: skipped: %v", name, err)
+			continue
+		}
+		idle, err := runnerIsIdle(status, r, name, ghRunners)
+		if err != nil {
+			log.Printf("%s: skipped: %v", name, err)
+			continue
+		}
+		if !idle {
+			continue
+		}
+		entries, err := ScanWorkDir(r.Dir)
+		if err != nil {
+			log.Printf("%s: skipped: %v", name, err)
+			continue
+		}
+		c := &cleanCandidate{
+			Name: name,
+			Ent: ent,
+			Running: status == `running`,
+			Entries: entries,
+		}
+		if c.Running {
+			c.PAT = pat
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// Selects work directory entries to remove according to the retention
+// policy.
+func planCleanup(candidates []*cleanCandidate, rc RetentionConfig) error {
+	var freed int64
+	now := time.Now()
+	var rest []WorkEntry
+	restOwner := make(map[string]*cleanCandidate)
+	for _, c := range candidates {
+		var size int64
+		for _, e := range c.Entries {
+			size += e.Size
+		}
+		for _, e := range c.Entries {
+			if (rc.MaxAge > 0 && now.Sub(e.ModTime) > rc.MaxAge) ||
+			   (rc.MaxSize > 0 && size > int64(rc.MaxSize)) {
+				// Entries are sorted oldest first
+				c.Remove = append(c.Remove, e)
+				size -= e.Size
+				freed += e.Size
+			} else {
+				rest = append(rest, e)
+				restOwner[e.Path] = c
+			}
+		}
+	}
+
+	if rc.MinFree > 0 {
+		free, err := FreeSpace(config.RunnersDir)
+		if err != nil {
+			return err
+		}
+		need := int64(rc.MinFree) - int64(free) - freed
+		sort.Slice(rest, func (i, j int) bool { return rest[i].ModTime.Before(rest[j].ModTime) })
+		for _, e := range rest {
+			if need <= 0 {
+				break
+			}
+			c := restOwner[e.Path]
+			c.Remove = append(c.Remove, e)
+			need -= e.Size
+		}
+		if need > 0 {
+			log.Printf("can't free enough space in %s: %s more needed", config.RunnersDir, ByteSize(need))
+		}
+	}
+	return nil
+}
+
+func printRemovals(c *cleanCandidate) {
+	for _, e := range c.Remove {
+		rel, _ := filepath.Rel(config.RunnersDir, e.Path)
+		fmt.Printf("%s: removing %s (%s, modified %s)\n", c.Name, rel, ByteSize(e.Size), e.ModTime.Format(time.RFC3339))
+	}
+}
+
+// Removes the selected entries, pausing the runner component meanwhile.
+// Returns ErrRunnerBusy if the runner has picked up a job since the
+// cleanup was planned.
+func cleanRunner(c *cleanCandidate, pc *PiesConfig) error {
+	if c.Running {
+		if busy, err := RunnerIsBusy(c.Ent, c.PAT, c.Name); err != nil {
+			return err
+		} else if busy {
+			return ErrRunnerBusy
+		}
+		if err := PiesStopComponent(pc.ControlURL, c.Name); err != nil {
+			return fmt.Errorf("can't stop: %v", err)
+		}
+		defer func() {
+			if err := PiesStartComponent(pc.ControlURL, c.Name); err != nil {
+				log.Printf("%s: can't start: %v", c.Name, err)
+			}
+		}()
+	}
+	printRemovals(c)
+	for _, e := range c.Remove {
+		if err := os.RemoveAll(e.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CleanRunners enforces the retention policy on idle runners of the given
+// entities.  Returns false if some of them could not be cleaned.
+func CleanRunners(keys []string, pc *PiesConfig, dryRun bool) bool {
+	success := true
+	var candidates []*cleanCandidate
+	for _, key := range keys {
+		c, err := cleanCandidates(key, pc)
+		if err != nil {
+			log.Printf("%s: %v", key, err)
+			success = false
+			continue
+		}
+		candidates = append(candidates, c...)
+	}
+
+	if err := planCleanup(candidates, config.Retention); err != nil {
+		log.Print(err)
+		return false
+	}
+
+	for _, c := range candidates {
+		if len(c.Remove) == 0 {
+			continue
+		}
+		if dryRun {
+			printRemovals(c)
+			continue
+		}
+		if err := cleanRunner(c, pc); errors.Is(err, ErrRunnerBusy) {
+			fmt.Printf("%s: busy, skipping\n", c.Name)
+		} else if err != nil {
+			log.Printf("%s: %v", c.Name, err)
+			success = false
+		}
+	}
+	return success
+}
+
+func CleanAction(args []string) {
+	ReadConfig()
+	FinalizeConfig()
+	optset := NewEntityOptset(args)
+	optset.SetParameters("")
+	var (
+		dryRun bool
+		interval time.Duration
+	)
+	optset.FlagLong(&dryRun, "dry-run", 'n', "Show what would be removed, but don't remove anything")
+	optset.FlagLong(&interval, "interval", 'i', "Run periodically with the given interval", "DURATION")
+	// Entity is optional: don't call optset.Parse
+	optset.Optset.Parse()
+
+	if len(optset.Args()) != 0 {
+		log.Fatalf("too many arguments; try `%s --help' for assistance", optset.Command)
+	}
+
+	if config.Retention.IsZero() {
+		log.Fatal("no retention policy configured")
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		// Don't hold the lock between iterations
+		lock, err := LockRoot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		pc, err := ParsePiesConfig(config.PiesConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var keys []string
+		if optset.Entity.Name != "" {
+			keys = append(keys, optset.Entity.BaseKey())
+			if _, ok := pc.Runners[keys[0]]; !ok {
+				log.Fatalf("found no runners for %s", keys[0])
+			}
+		} else {
+			for key := range pc.Runners {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+		}
+
+		success := CleanRunners(keys, pc, dryRun)
+		lock.Unlock()
+		if interval == 0 {
+			if !success {
+				os.Exit(1)
+			}
+			break
+		}
+
+		select {
+		case <-time.After(interval):
+		case sig := <-sigchan:
+			log.Printf("got %s, exiting", sig)
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"errors"
+	"sort"
+	"strings"
+	"strconv"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Runner environment
+// ----------------------------------
+
+func EnvAction(args []string) {
+	ReadConfig()
+	FinalizeConfig()
+	optset := NewEntityOptset(args)
+	optset.SetParameters("list|get VAR...|set VAR=VALUE...|unset VAR...")
+	runnerNum := -1
+	noRestart := false
+	optset.FlagLong(&runnerNum, "id", 'i', "Runner ID (default: all runners of the entity)", "NUMBER")
+	optset.FlagLong(&noRestart, "no-restart", 'N', "Don't restart runners after modifying their environment")
+	optset.Parse()
+
+	args = optset.Args()
+	if len(args) == 0 {
+		log.Fatalf("subcommand missing; try `%s --help' for assistance", optset.Command)
+	}
+	subcommand := args[0]
+	args = args[1:]
+	var assignments [][2]string
+	switch subcommand {
+	case `list`:
+		if len(args) > 0 {
+			log.Fatalf("too many arguments; try `%s --help' for assistance", optset.Command)
+		}
+	case `get`, `unset`:
+		if len(args) == 0 {
+			log.Fatalf("no variables given; try `%s --help' for assistance", optset.Command)
+		}
+		for _, name := range args {
+			if err := CheckEnvVariable(name, ""); err != nil {
+				log.Fatal(err)
+			}
+		}
+	case `set`:
+		if len(args) == 0 {
+			log.Fatalf("no assignments given; try `%s --help' for assistance", optset.Command)
+		}
+		for _, arg := range args {
+			kv := strings.SplitN(arg, `=`, 2)
+			if len(kv) != 2 {
+				log.Fatalf("%s: expected VAR=VALUE", arg)
+			}
+			if err := CheckEnvVariable(kv[0], kv[1]); err != nil {
+				log.Fatal(err)
+			}
+			assignments = append(assignments, [2]string{kv[0], kv[1]})
+		}
+	default:
+		log.Fatalf("unrecognized subcommand; try `%s --help' for assistance", optset.Command)
+	}
+
+	if optset.Entity.Type == EntityRepo && strings.Index(optset.Entity.Name, `/`) == -1 {
+		log.Fatal("--repo requires full repository name (OWNER/REPO)")
+	}
+
+	if subcommand == `set` || subcommand == `unset` {
+		lock, err := LockRoot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer lock.Unlock()
+	}
+
+	pc, err := ParsePiesConfig(config.PiesConfigFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	key := optset.Entity.BaseKey()
+	r, ok := pc.Runners[key]
+	if !ok {
+		log.Fatalf("found no runners for %s", key)
+	}
+	if runnerNum != -1 {
+		i := sort.Search(len(r), func(i int) bool { return r[i].Num >= runnerNum })
+		if !(i < len(r) && r[i].Num == runnerNum) {
+			log.Fatalf("%s: no runner %d", key, runnerNum)
+		}
+		r = r[i:i+1]
+	}
+
+	failed := false
+	for _, runner := range r {
+		name := filepath.Join(key, strconv.Itoa(runner.Num))
+		re, err := ReadRunnerEnv(runner.Dir)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			failed = true
+			continue
+		}
+
+		switch subcommand {
+		case `list`:
+			for _, line := range re.List() {
+				fmt.Printf("%s: %s\n", name, line)
+			}
+			continue
+
+		case `get`:
+			for _, v := range args {
+				if value, ok := re.Get(v); ok {
+					fmt.Printf("%s: %s=%s\n", name, v, value)
+				} else {
+					fmt.Printf("%s: %s is not set\n", name, v)
+				}
+			}
+			continue
+
+		case `set`:
+			for _, a := range assignments {
+				re.Set(a[0], a[1])
+			}
+
+		case `unset`:
+			for _, v := range args {
+				re.Unset(v)
+			}
+		}
+
+		if err := re.Save(); err != nil {
+			log.Printf("%s: %v", name, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: updated\n", name)
+		if !noRestart {
+			if err := RestartIdleRunner(optset.Entity, pc.ControlURL, name); errors.Is(err, ErrRunnerBusy) {
+				fmt.Printf("%s: busy, restart pending\n", name)
+			} else if err != nil {
+				log.Printf("%s: can't restart: %v", name, err)
+				failed = true
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
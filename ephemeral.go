@@ -0,0 +1,229 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"errors"
+	"strings"
+	"runtime"
+	"syscall"
+	"encoding/json"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Ephemeral runners
+// ----------------------------------
+
+// Ephemeral runners are not registered when added.  Instead, their pies
+// component runs "ghb ephemeral RUNNERNAME", which cleans up the runner
+// directory, registers the runner for a single job and execs run.sh.  When
+// the job is finished, the runner exits and pies starts the cycle anew.
+
+// Name of the file in the runner directory keeping the ephemeral runner
+// settings.
+const EphemeralSettingsFile = `.ghb-ephemeral`
+
+type EphemeralSettings struct {
+	Name string         `json:"name"`
+	URL string          `json:"url"`
+	Labels []string     `json:"labels,omitempty"`
+	RunnerGroup string  `json:"runnergroup,omitempty"`
+}
+
+// Files and directories removed from the runner directory before each
+// registration.
+var ephemeralCleanupList = []string{
+	`.runner`,
+	`.credentials`,
+	`.credentials_rsaparams`,
+	`_work`,
+	`_diag`,
+}
+
+func ReadEphemeralSettings(dirname string) (es EphemeralSettings, err error) {
+	var js []byte
+	if js, err = ioutil.ReadFile(filepath.Join(dirname, EphemeralSettingsFile)); err == nil {
+		err = json.Unmarshal(js, &es)
+	}
+	return
+}
+
+func IsEphemeralRunner(dirname string) bool {
+	_, err := os.Stat(filepath.Join(dirname, EphemeralSettingsFile))
+	return err == nil
+}
+
+func InstallEphemeral(arc, projectName string, es EphemeralSettings, out io.Writer) error {
+	dirname := filepath.Join(config.RunnersDir, projectName)
+	if err := ExtractRunner(arc, dirname, out); err != nil {
+		return err
+	}
+	js, err := json.Marshal(es)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dirname, EphemeralSettingsFile)
+	if err := ioutil.WriteFile(filename, js, 0640); err != nil {
+		return fmt.Errorf("can't write %s: %v", filename, err)
+	}
+	return SetupRunnerEnv(projectName)
+}
+
+// Default labels assigned to a runner by config.sh.
+func defaultRunnerLabels() []string {
+	osname := runtime.GOOS
+	switch osname {
+	case "darwin":
+		osname = "macOS"
+	default:
+		osname = strings.ToUpper(osname[:1]) + osname[1:]
+	}
+	arch := runtime.GOARCH
+	switch arch {
+	case "amd64":
+		arch = "X64"
+	default:
+		arch = strings.ToUpper(arch)
+	}
+	return []string{`self-hosted`, osname, arch}
+}
+
+func cleanupEphemeral(dirname string) error {
+	for _, name := range ephemeralCleanupList {
+		if err := os.RemoveAll(filepath.Join(dirname, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveEphemeralRunner deregisters the ephemeral runner (if it is
+// registered) and removes its directory.
+func RemoveEphemeralRunner(ent entityValue, projectName, dirname string) error {
+	name, err := RegisteredRunnerName(dirname, projectName)
+	if err != nil {
+		return err
+	}
+	if pat, err := GetToken(ent.PATKey()); err == nil {
+		if r, err := GitHubFindRunner(ent, pat, name); err != nil {
+			return err
+		} else if r != nil {
+			if err := GitHubDeleteRunner(ent, pat, r.ID); err != nil {
+				return err
+			}
+		}
+	} else if errors.Is(err, ErrTokenNotFound) {
+		log.Printf("no PAT for %s; runner %s will expire at GitHub", ent.PATKey(), name)
+	} else {
+		return err
+	}
+
+	if err := os.RemoveAll(dirname); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", dirname, err)
+	}
+	return nil
+}
+
+func EphemeralAction(args []string) {
+	ReadConfig()
+	optset := NewOptset(args)
+	optset.SetParameters("RUNNERNAME")
+	optset.Parse()
+
+	args = optset.Args()
+	if len(args) != 1 {
+		log.Fatalf("bad number of arguments; try `%s --help' for assistance", optset.Command)
+	}
+	projectName := args[0]
+
+	ent, _, err := ParseRunnerName(projectName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dirname := filepath.Join(config.RunnersDir, projectName)
+	es, err := ReadEphemeralSettings(dirname)
+	if err != nil {
+		log.Fatalf("%s: not an ephemeral runner: %v", dirname, err)
+	}
+
+	if err := os.Chdir(dirname); err != nil {
+		log.Fatalf("can't chdir to %s: %v", dirname, err)
+	}
+	if err := cleanupEphemeral(dirname); err != nil {
+		log.Fatalf("can't clean up %s: %v", dirname, err)
+	}
+
+	name := es.Name
+	if name == "" {
+		if name, err = RunnerName(projectName, es.Labels); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var runArgs []string
+	if pat, err := GetToken(ent.PATKey()); err == nil {
+		// Remove stale registration left if the previous instance
+		// terminated before running a job.
+		if r, err := GitHubFindRunner(ent, pat, name); err != nil {
+			log.Fatal(err)
+		} else if r != nil {
+			if err := GitHubDeleteRunner(ent, pat, r.ID); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		groupID, err := GitHubRunnerGroupID(ent, pat, es.RunnerGroup)
+		if err != nil {
+			log.Fatal(err)
+		}
+		jit, err := GitHubGenerateJITConfig(ent, pat, name, groupID, append(defaultRunnerLabels(), es.Labels...))
+		if err != nil {
+			log.Fatal(err)
+		}
+		runArgs = []string{"--jitconfig", jit}
+	} else if errors.Is(err, ErrTokenNotFound) {
+		// No PAT: try to register using a cached registration token
+		token, err := GetToken(ent.TokenKey(RegistrationToken))
+		if err != nil {
+			log.Fatal(err)
+		}
+		cmdline := []string{
+			"--name", name,
+			"--url", es.URL,
+			"--token", token,
+			"--unattended",
+			"--ephemeral",
+			"--replace",
+		}
+		if len(es.Labels) > 0 {
+			cmdline = append(cmdline, "--labels", strings.Join(es.Labels, ","))
+		}
+		if es.RunnerGroup != "" {
+			cmdline = append(cmdline, "--runnergroup", es.RunnerGroup)
+		}
+		cmd := exec.Command("./config.sh", cmdline...)
+		cmd.Env = runnerConfigEnv()
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Fatalf("Error running config.sh: %v", err)
+		}
+	} else {
+		log.Fatal(err)
+	}
+
+	// Replace ourselves with the runner, so that pies controls it directly
+	runsh := filepath.Join(dirname, "run.sh")
+	err = syscall.Exec(runsh, append([]string{"./run.sh"}, runArgs...), os.Environ())
+	log.Fatalf("can't execute %s: %v", runsh, err)
+}
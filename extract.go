@@ -0,0 +1,226 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"io"
+	"strings"
+	"path/filepath"
+	"archive/tar"
+	"compress/gzip"
+)
+
+// ----------------------------------
+// Built-in runner archive extractor
+// ----------------------------------
+
+// Counts bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// Returns the pathname relative to the extraction directory, or error if
+// name is unsafe (absolute or pointing outside of the directory).
+func safeArchivePath(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("%s: absolute file name in archive", name)
+	}
+	rel := filepath.Clean(name)
+	if rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: file name points outside of the extraction directory", name)
+	}
+	return rel, nil
+}
+
+// Checks that the link target does not point outside of the extraction
+// directory.  Rel is the relative pathname of the link itself.
+func safeLinkTarget(rel, target string) error {
+	if filepath.IsAbs(target) {
+		return fmt.Errorf("%s: link to absolute file name %s", rel, target)
+	}
+	if _, err := safeArchivePath(filepath.Join(filepath.Dir(rel), target)); err != nil {
+		return fmt.Errorf("%s: link target %s points outside of the extraction directory", rel, target)
+	}
+	return nil
+}
+
+// Checks that none of the directories leading to rel inside dirname is
+// a symbolic link.  Otherwise, a chain of symlinks, each of which looks
+// safe by itself, could be used to write outside of dirname.  If self
+// is true, rel itself is checked as well.
+func checkNoSymlinks(dirname, rel string, self bool) error {
+	dir := filepath.Dir(rel)
+	if self {
+		dir = rel
+	}
+	if dir == "." {
+		return nil
+	}
+	p := dirname
+	for _, comp := range strings.Split(dir, string(filepath.Separator)) {
+		p = filepath.Join(p, comp)
+		st, err := os.Lstat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The rest will be created as directories
+				return nil
+			}
+			return err
+		}
+		if st.Mode() & os.ModeSymlink != 0 {
+			return fmt.Errorf("%s: path traverses symbolic link %s", rel, p)
+		}
+	}
+	return nil
+}
+
+func extractFile(tr *tar.Reader, filename string, mode os.FileMode) error {
+	// Remove existing file first: it may be a running executable or
+	// a symlink.
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, tr); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ExtractTarGz extracts the gzipped tar archive arc into the directory
+// dirname.  Archive members with unsafe names are rejected.  File modes
+// and symbolic links are preserved.  Progress is reported to out.
+func ExtractTarGz(arc, dirname string, out io.Writer) error {
+	file, err := os.Open(arc)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	st, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	cr := &countingReader{r: file}
+	gz, err := gzip.NewReader(cr)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	nfiles := 0
+	lastPercent := int64(0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		rel, err := safeArchivePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			continue
+		}
+		if err := checkNoSymlinks(dirname, rel, hdr.Typeflag == tar.TypeDir); err != nil {
+			return err
+		}
+		filename := filepath.Join(dirname, rel)
+		mode := hdr.FileInfo().Mode().Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(filename, mode|0700); err != nil {
+				return err
+			}
+
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+				return err
+			}
+			if err := extractFile(tr, filename, mode); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err := safeLinkTarget(rel, hdr.Linkname); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+				return err
+			}
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, filename); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			target, err := safeArchivePath(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			// Chmod below would follow the link if the target
+			// were a symlink
+			if err := checkNoSymlinks(dirname, target, true); err != nil {
+				return err
+			}
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Link(filepath.Join(dirname, target), filename); err != nil {
+				return err
+			}
+
+		case tar.TypeXGlobalHeader:
+			continue
+
+		default:
+			return fmt.Errorf("%s: unsupported archive member type %c", hdr.Name, hdr.Typeflag)
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			// Keep directories writable for the rest of extraction
+			mode |= 0700
+		}
+		if hdr.Typeflag != tar.TypeSymlink {
+			// Set the mode explicitly, since it is affected by umask
+			if err := os.Chmod(filename, mode); err != nil {
+				return err
+			}
+			os.Chtimes(filename, hdr.ModTime, hdr.ModTime)
+		}
+		nfiles++
+
+		if st.Size() > 0 {
+			if percent := cr.n * 100 / st.Size(); percent / 10 > lastPercent / 10 {
+				fmt.Fprintf(out, "  %3d%% (%d files)\n", percent, nfiles)
+				lastPercent = percent
+			}
+		}
+	}
+	fmt.Fprintf(out, "Extracted %d files\n", nfiles)
+	return nil
+}
@@ -11,13 +11,18 @@ import (
 	"fmt"
 	"errors"
 	"net/http"
-	"github.com/graygnuorg/go-gdbm"
 	"encoding/json"
 	"path/filepath"
 	"strings"
 	"io"
 	"io/ioutil"
 	"runtime"
+	"bytes"
+	"strconv"
+	"net/url"
+	"crypto/sha256"
+	"regexp"
+	"encoding/hex"
 )
 
 // ----------------------------------
@@ -31,6 +36,7 @@ const (
 
 	RemoveToken = `remove-token`
 	RegistrationToken = `registration-token`
+	JITConfig = `generate-jitconfig`
 )
 
 var GHEntityPrefix = []string{
@@ -43,130 +49,72 @@ func (ent entityValue) BaseKey() string {
 	return GHEntityPrefix[ent.Type] + ent.Name
 }
 
-func (ent entityValue) PATKey() string {
+// Returns the base key of the entity owner, i.e. the owner of the
+// repository for repositories and the base key itself otherwise.
+func (ent entityValue) ownerKey() string {
 	if n := strings.IndexRune(ent.Name, '/'); n != -1 {
 		return GHEntityPrefix[ent.Type] + ent.Name[:n]
 	}
 	return ent.BaseKey()
 }
 
+func (ent entityValue) PATKey() string {
+	return ent.Namespace() + ent.ownerKey()
+}
+
 func (ent entityValue) TokenKey(kind string) string {
-	return ent.BaseKey() + `/actions/runners/` + kind
+	return ent.HostKey() + `/actions/runners/` + kind
 }
 
 func (ent entityValue) ProjectURL(name string) (url string) {
-	url = `https://github.com/` + ent.Name
+	web, _ := ent.GitHubURLs()
+	url = web + `/` + ent.Name
 	if name != "" {
 		url += `/` + name
 	}
 	return
 }
 
-type GHToken struct {
-	Token string         `json:"token"`
-	ExpiresAt time.Time  `json:"expires_at"`
-}
-
-var (
-	ErrTokenNotFound = errors.New("Token not found")
-)
-
-func SaveToken(key string, token GHToken) error {
-	js, err := json.Marshal(token)
-	if err != nil {
-		return nil
-	}
-
-	dbname := filepath.Join(config.CacheDir, `token.db`)
-	db, err := gdbm.Open(dbname, gdbm.ModeWrcreat)
-	if err != nil {
-		return fmt.Errorf("can't open database file %s for update: %v", dbname, err)
-	}
-	defer db.Close()
-	if err := db.Store([]byte(key), js, true); err != nil {
-		return fmt.Errorf("can't store key %s: %v", key, err)
-	}
-	return nil
-}
-
-func FetchRawToken(key string) (GHToken, error) {
-	dbname := filepath.Join(config.CacheDir, `token.db`)
-	db, err := gdbm.Open(dbname, gdbm.ModeReader)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			err = ErrTokenNotFound
+// ParseEntityKey is the reverse of BaseKey: it converts the base key
+// (e.g. "/repos/foo/bar") to the entity.
+func ParseEntityKey(key string) (ent entityValue, err error) {
+	for t, pfx := range GHEntityPrefix {
+		if s := strings.TrimPrefix(key, pfx); s != key && s != "" {
+			ent = entityValue{Type: t, Name: s}
+			return
 		}
-		return GHToken{}, err
-	}
-	defer db.Close()
-	if js, err := db.Fetch([]byte(key)); err == nil {
-		var tok GHToken
-		err := json.Unmarshal(js, &tok)
-		return tok, err
-	} else if errors.Is(err, gdbm.ErrItemNotFound) {
-		return GHToken{}, ErrTokenNotFound
-	} else {
-		return GHToken{}, err
 	}
+	err = fmt.Errorf("%s: malformed entity key", key)
+	return
 }
 
-func FetchToken(key string) (string, error) {
-	if tok, err := FetchRawToken(key); err == nil {
-		if time.Now().Before(tok.ExpiresAt) {
-			return tok.Token, nil
+// ParseRunnerName splits the runner name (the name of its directory
+// relative to RunnersDir, e.g. "/repos/foo/bar/0") into the entity
+// and the ordinal number of the runner.
+func ParseRunnerName(name string) (ent entityValue, num int, err error) {
+	if n := strings.LastIndexByte(name, '/'); n > 0 {
+		if num, err = strconv.Atoi(name[n+1:]); err == nil {
+			if ent, err = ParseEntityKey(name[:n]); err == nil {
+				return
+			}
 		}
-		return "", ErrTokenNotFound
-	} else {
-		return "", err
-	}
-}
-
-func DeleteToken(key string) error {
-	dbname := filepath.Join(config.CacheDir, `token.db`)
-	db, err := gdbm.Open(dbname, gdbm.ModeWrcreat)
-	if err != nil {
-		return fmt.Errorf("can't open database file %s for update: %v", dbname, err)
 	}
-	defer db.Close()
-	return db.Delete([]byte(key))
+	err = fmt.Errorf("%s: malformed runner name", name)
+	return
 }
 
-func PrefixIterator(pfx string) (func () (string, GHToken, error), error) {
-	dbname := filepath.Join(config.CacheDir, `token.db`)
-	db, err := gdbm.Open(dbname, gdbm.ModeReader)
-	if err != nil {
-		return nil, err
-	}
-
-	next := db.Iterator()
-	return func() (key string, tok GHToken, err error) {
-		for {
-			var b []byte
-			b, err = next()
-			if err == nil {
-				key = string(b)
-				if key != pfx && strings.TrimPrefix(key, pfx) != key {
-					var js []byte
-					if js, err = db.Fetch(b); err == nil {
-						if err = json.Unmarshal(js, &tok); err == nil {
-							return
-						}
-					}
-					break
-				}
-			} else {
-				break
-			}
-		}
-		db.Close()
-		return
-	}, nil
+type GHToken struct {
+	Token string         `json:"token"`
+	ExpiresAt time.Time  `json:"expires_at"`
 }
 
+var (
+	ErrTokenNotFound = errors.New("Token not found")
+)
 
 func getGitHubToken(key, pat string) (token GHToken, err error) {
 	var req *http.Request
-	req, err = http.NewRequest(http.MethodPost, `https://api.github.com` + key, nil)
+	req, err = http.NewRequest(http.MethodPost, APIURL(key), nil)
 	if err != nil {
 		return
 	}
@@ -176,7 +124,7 @@ func getGitHubToken(key, pat string) (token GHToken, err error) {
 	fmt.Printf("Getting token for %s\n", req.URL.String())
 	//fmt.Printf("%#v",req)
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = HTTPDo(req)
 	if err != nil {
 		return
 	}
@@ -188,12 +136,15 @@ func getGitHubToken(key, pat string) (token GHToken, err error) {
 	if resp.StatusCode == 201 {
 		err = json.Unmarshal(body, &token)
 	} else {
-		err = ErrTokenNotFound
+		err = NewGitHubAPIError(http.MethodPost, key, resp, body)
 	}
 	return
 }
 
+// GetBaseKey returns the PAT key for the token key and a boolean
+// indicating whether key is a PAT key itself.
 func GetBaseKey(key string) (patkey string, ispat bool) {
+	host, key := SplitKey(key)
 	for _, pfx := range GHEntityPrefix {
 		if s := strings.TrimPrefix(key, pfx); s != key {
 			if n := strings.IndexRune(s, '/'); n == -1 {
@@ -204,19 +155,29 @@ func GetBaseKey(key string) (patkey string, ispat bool) {
 				ispat = false
 				patkey = patkey + s[:n]
 			}
+			patkey = host + patkey
 			break
 		}
 	}
 	return
 }
 
+// GetToken returns the token for the given key.  For PAT keys, if a
+// GitHub App is configured for the entity, returns its installation access
+// token.  Other tokens are obtained from GitHub using the PAT, if they
+// are missing or expired.
 func GetToken(key string) (string, error) {
+	if patkey, ispat := GetBaseKey(key); ispat {
+		if app := AppConfigFor(patkey); app != nil {
+			return GetAppToken(patkey, app)
+		}
+	}
 	if token, err := FetchToken(key); err == nil {
 		return token, err
 	} else if errors.Is(err, ErrTokenNotFound) {
 		if patkey, ispat := GetBaseKey(key); ispat {
 			return "", err
-		} else if token, err := FetchToken(patkey); err == nil {
+		} else if token, err := GetToken(patkey); err == nil {
 			if tok, err := getGitHubToken(key, token); err != nil {
 				return "", err
 			} else {
@@ -231,6 +192,292 @@ func GetToken(key string) (string, error) {
 	}
 }
 
+// GitHubAPI sends a request to the GitHub REST API endpoint path,
+// authenticating it with the given token.  If input is not nil, it is
+// sent as a JSON request body.  If output is not nil, the JSON response
+// is unmarshalled into it.
+func GitHubAPI(method, path, token string, input, output interface{}) error {
+	return gitHubRequest(method, path, "token " + token, input, output)
+}
+
+// Sends the API request with the given Authorization header.
+func gitHubRequest(method, path, auth string, input, output interface{}) error {
+	var body io.Reader
+	if input != nil {
+		js, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(js)
+	}
+
+	req, err := http.NewRequest(method, APIURL(path), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("Authorization", auth)
+	if input != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+
+	resp, err := HTTPDo(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return NewGitHubAPIError(method, path, resp, reply)
+	}
+	if output != nil && len(reply) > 0 {
+		return json.Unmarshal(reply, output)
+	}
+	return nil
+}
+
+type GHLabel struct {
+	ID int          `json:"id,omitempty"`
+	Name string     `json:"name"`
+	Type string     `json:"type,omitempty"`
+}
+
+type GHRunner struct {
+	ID int            `json:"id"`
+	Name string       `json:"name"`
+	OS string         `json:"os"`
+	Status string     `json:"status"`
+	Busy bool         `json:"busy"`
+	Labels []GHLabel  `json:"labels"`
+}
+
+// GitHubListRunners returns the list of self-hosted runners registered
+// for the entity.
+func GitHubListRunners(ent entityValue, pat string) (runners []GHRunner, err error) {
+	for page := 1; ; page++ {
+		var reply struct {
+			TotalCount int       `json:"total_count"`
+			Runners []GHRunner   `json:"runners"`
+		}
+		path := fmt.Sprintf("%s/actions/runners?per_page=100&page=%d", ent.HostKey(), page)
+		if err = GitHubAPI(http.MethodGet, path, pat, nil, &reply); err != nil {
+			return
+		}
+		runners = append(runners, reply.Runners...)
+		if len(reply.Runners) == 0 || len(runners) >= reply.TotalCount {
+			break
+		}
+	}
+	return
+}
+
+// GitHubFindRunner looks up the registered runner with the given name.
+// Returns nil if not found.
+func GitHubFindRunner(ent entityValue, pat, name string) (*GHRunner, error) {
+	runners, err := GitHubListRunners(ent, pat)
+	if err != nil {
+		return nil, err
+	}
+	for i := range runners {
+		if runners[i].Name == name {
+			return &runners[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// RunnerIsBusy returns true if GitHub reports the runner projectName
+// (e.g. "/orgs/foo/0") of the entity as running a job.
+func RunnerIsBusy(ent entityValue, pat, projectName string) (bool, error) {
+	name, err := RegisteredRunnerName(filepath.Join(config.RunnersDir, projectName), projectName)
+	if err != nil {
+		return false, err
+	}
+	r, err := GitHubFindRunner(ent, pat, name)
+	if err != nil {
+		return false, err
+	}
+	return r != nil && r.Busy, nil
+}
+
+func GitHubDeleteRunner(ent entityValue, pat string, id int) error {
+	return GitHubAPI(http.MethodDelete, fmt.Sprintf("%s/actions/runners/%d", ent.HostKey(), id), pat, nil, nil)
+}
+
+func runnerLabelsPath(ent entityValue, id int) string {
+	return fmt.Sprintf("%s/actions/runners/%d/labels", ent.HostKey(), id)
+}
+
+type ghLabelsReply struct {
+	TotalCount int     `json:"total_count"`
+	Labels []GHLabel   `json:"labels"`
+}
+
+type ghLabelsRequest struct {
+	Labels []string    `json:"labels"`
+}
+
+// GitHubRunnerLabels returns all labels of the runner with the given ID.
+func GitHubRunnerLabels(ent entityValue, pat string, id int) ([]GHLabel, error) {
+	var reply ghLabelsReply
+	err := GitHubAPI(http.MethodGet, runnerLabelsPath(ent, id), pat, nil, &reply)
+	return reply.Labels, err
+}
+
+// GitHubAddRunnerLabels adds custom labels to the runner.  Returns the
+// resulting list of labels.
+func GitHubAddRunnerLabels(ent entityValue, pat string, id int, labels []string) ([]GHLabel, error) {
+	var reply ghLabelsReply
+	err := GitHubAPI(http.MethodPost, runnerLabelsPath(ent, id), pat, ghLabelsRequest{labels}, &reply)
+	return reply.Labels, err
+}
+
+// GitHubSetRunnerLabels replaces all custom labels of the runner.
+func GitHubSetRunnerLabels(ent entityValue, pat string, id int, labels []string) ([]GHLabel, error) {
+	var reply ghLabelsReply
+	err := GitHubAPI(http.MethodPut, runnerLabelsPath(ent, id), pat, ghLabelsRequest{labels}, &reply)
+	return reply.Labels, err
+}
+
+// GitHubRemoveRunnerLabel removes a custom label from the runner.
+func GitHubRemoveRunnerLabel(ent entityValue, pat string, id int, label string) ([]GHLabel, error) {
+	var reply ghLabelsReply
+	err := GitHubAPI(http.MethodDelete, runnerLabelsPath(ent, id) + `/` + url.PathEscape(label), pat, nil, &reply)
+	return reply.Labels, err
+}
+
+// GitHubRunnerGroupID returns the ID of the runner group with the given
+// name.  Repositories have only the default group, whose ID is 1.
+func GitHubRunnerGroupID(ent entityValue, pat, name string) (int, error) {
+	if name == "" || ent.Type == EntityRepo {
+		return 1, nil
+	}
+	var reply struct {
+		RunnerGroups []struct {
+			ID int       `json:"id"`
+			Name string  `json:"name"`
+		} `json:"runner_groups"`
+	}
+	if err := GitHubAPI(http.MethodGet, ent.HostKey() + `/actions/runner-groups?per_page=100`, pat, nil, &reply); err != nil {
+		return 0, err
+	}
+	for _, g := range reply.RunnerGroups {
+		if g.Name == name {
+			return g.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: no such runner group", name)
+}
+
+// GitHubGenerateJITConfig obtains just-in-time configuration for the
+// runner with the given name.  The returned string is suitable as
+// argument to the --jitconfig option of run.sh.
+func GitHubGenerateJITConfig(ent entityValue, pat, name string, groupID int, labels []string) (string, error) {
+	input := struct {
+		Name string           `json:"name"`
+		RunnerGroupID int     `json:"runner_group_id"`
+		Labels []string       `json:"labels"`
+		WorkFolder string     `json:"work_folder"`
+	}{
+		Name: name,
+		RunnerGroupID: groupID,
+		Labels: labels,
+		WorkFolder: `_work`,
+	}
+	var reply struct {
+		Runner GHRunner          `json:"runner"`
+		EncodedJITConfig string  `json:"encoded_jit_config"`
+	}
+	if err := GitHubAPI(http.MethodPost, ent.TokenKey(JITConfig), pat, input, &reply); err != nil {
+		return "", err
+	}
+	return reply.EncodedJITConfig, nil
+}
+
+type GHWorkflowJob struct {
+	ID int            `json:"id"`
+	RunID int         `json:"run_id"`
+	Name string       `json:"name"`
+	Status string     `json:"status"`
+	Labels []string   `json:"labels"`
+	RunnerName string `json:"runner_name"`
+}
+
+// GitHubQueuedJobs returns the list of queued workflow jobs in the
+// repository repo ("OWNER/NAME") on the given host (see SplitKey).
+func GitHubQueuedJobs(host, repo, pat string) (jobs []GHWorkflowJob, err error) {
+	for _, status := range []string{`queued`, `in_progress`} {
+		for page := 1; ; page++ {
+			var runs struct {
+				WorkflowRuns []struct {
+					ID int `json:"id"`
+				} `json:"workflow_runs"`
+			}
+			path := fmt.Sprintf("%s/repos/%s/actions/runs?status=%s&per_page=100&page=%d", host, repo, status, page)
+			if err = GitHubAPI(http.MethodGet, path, pat, nil, &runs); err != nil {
+				return
+			}
+			for _, run := range runs.WorkflowRuns {
+				var rj []GHWorkflowJob
+				if rj, err = gitHubRunQueuedJobs(host, repo, run.ID, pat); err != nil {
+					return
+				}
+				jobs = append(jobs, rj...)
+			}
+			if len(runs.WorkflowRuns) < 100 {
+				break
+			}
+		}
+	}
+	return
+}
+
+// Returns queued jobs of the workflow run id.
+func gitHubRunQueuedJobs(host, repo string, id int, pat string) (jobs []GHWorkflowJob, err error) {
+	for page := 1; ; page++ {
+		var reply struct {
+			Jobs []GHWorkflowJob `json:"jobs"`
+		}
+		path := fmt.Sprintf("%s/repos/%s/actions/runs/%d/jobs?per_page=100&page=%d", host, repo, id, page)
+		if err = GitHubAPI(http.MethodGet, path, pat, nil, &reply); err != nil {
+			return
+		}
+		for _, job := range reply.Jobs {
+			if job.Status == `queued` {
+				jobs = append(jobs, job)
+			}
+		}
+		if len(reply.Jobs) < 100 {
+			break
+		}
+	}
+	return
+}
+
+// GitHubOrgRepos returns full names of the repositories in organization
+// org on the given host.
+func GitHubOrgRepos(host, org, pat string) (repos []string, err error) {
+	for page := 1; ; page++ {
+		var reply []struct {
+			FullName string `json:"full_name"`
+		}
+		path := fmt.Sprintf("%s/orgs/%s/repos?per_page=100&page=%d", host, org, page)
+		if err = GitHubAPI(http.MethodGet, path, pat, nil, &reply); err != nil {
+			return
+		}
+		for _, r := range reply {
+			repos = append(repos, r.FullName)
+		}
+		if len(reply) < 100 {
+			break
+		}
+	}
+	return
+}
+
 type GHDownload struct {
 	OS string        `json:"os"`
 	Arch string      `json:"architecture"`
@@ -242,22 +489,22 @@ type GHDownload struct {
 func GitHubGetDownloads(ent entityValue) (downloads []GHDownload, err error) {
 	var req *http.Request
 
-	key := ent.BaseKey() + `/actions/runners/downloads`
+	key := ent.HostKey() + `/actions/runners/downloads`
 
-	req, err = http.NewRequest(http.MethodGet, `https://api.github.com` + key, nil)
+	req, err = http.NewRequest(http.MethodGet, APIURL(key), nil)
 	if err != nil {
 		return
 	}
 
 	var pat string
-	if pat, err = FetchToken(ent.PATKey()); err != nil {
+	if pat, err = GetToken(ent.PATKey()); err != nil {
 		return
 	}
 
 	req.Header.Add("Accept", "application/vnd.github+json")
 	req.Header.Add("Authorization", "token " + pat)
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = HTTPDo(req)
 	if err != nil {
 		return
 	}
@@ -269,68 +516,351 @@ func GitHubGetDownloads(ent entityValue) (downloads []GHDownload, err error) {
 	if resp.StatusCode == 200 {
 		err = json.Unmarshal(body, &downloads)
 	} else {
-		err = errors.New(resp.Status)
+		err = NewGitHubAPIError(http.MethodGet, key, resp, body)
 	}
 	return
 }
 
-func GitHubSelectDownload(ent entityValue) (GHDownload, error) {
+// HostPlatform returns the OS and architecture of this host, as named in
+// GitHub runner downloads.
+func HostPlatform() (osname, arch string) {
+	osname = runtime.GOOS
+	if osname == "darwin" {
+		osname = "osx"
+	}
+	arch = runtime.GOARCH
+	if arch == "amd64" {
+		arch = "x64"
+	}
+	return
+}
+
+// GitHubSelectPlatformDownload selects the runner download for the given
+// OS and architecture.
+func GitHubSelectPlatformDownload(ent entityValue, osname, arch string) (GHDownload, error) {
 	res, err := GitHubGetDownloads(ent)
-	if err == nil {
-		arch := runtime.GOARCH
-		if arch == "amd64" {
-			arch = "x64"
+	if err != nil {
+		return GHDownload{}, err
+	}
+	fmt.Printf("Looking for runner tarball for %s %s\n", osname, arch)
+	for _, dn := range res {
+		if dn.OS == osname && dn.Arch == arch {
+			return dn, nil
 		}
-		fmt.Printf("Looking for runner tarball for %s %s\n", runtime.GOOS, arch)
-		for _, dn := range res {
-			if dn.OS == runtime.GOOS && dn.Arch == arch {
-				return dn, nil
+	}
+	return GHDownload{}, fmt.Errorf("no runner tarball for %s %s", osname, arch)
+}
+
+func GitHubSelectDownload(ent entityValue) (GHDownload, error) {
+	osname, arch := HostPlatform()
+	return GitHubSelectPlatformDownload(ent, osname, arch)
+}
+
+// Public repository of the runner software.
+const RunnerReleasesURL = `https://api.github.com/repos/actions/runner/releases/latest`
+
+// GitHubSelectReleaseDownload selects the runner download for the given
+// OS and architecture from the metadata of the latest release of the
+// actions/runner repository.  It doesn't require authentication.
+func GitHubSelectReleaseDownload(osname, arch string) (dn GHDownload, err error) {
+	var req *http.Request
+	req, err = http.NewRequest(http.MethodGet, RunnerReleasesURL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Add("Accept", "application/vnd.github+json")
+
+	var resp *http.Response
+	resp, err = HTTPDo(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var body []byte
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if resp.StatusCode != 200 {
+		err = NewGitHubAPIError(http.MethodGet, req.URL.Path, resp, body)
+		return
+	}
+
+	var release struct {
+		TagName string          `json:"tag_name"`
+		Body string             `json:"body"`
+		Assets []struct {
+			Name string     `json:"name"`
+			URL string      `json:"browser_download_url"`
+		}                       `json:"assets"`
+	}
+	if err = json.Unmarshal(body, &release); err != nil {
+		return
+	}
+
+	fmt.Printf("Looking for runner tarball for %s %s in release %s\n", osname, arch, release.TagName)
+	name := ArchiveName(osname, arch, strings.TrimPrefix(release.TagName, `v`))
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			dn = GHDownload{
+				OS: osname,
+				Arch: arch,
+				URL: asset.URL,
+				FileName: asset.Name,
 			}
+			// Release notes contain checksums in the form
+			//   <!-- BEGIN SHA linux-x64 -->HEX<!-- END SHA linux-x64 -->
+			rx := regexp.MustCompile(`<!-- BEGIN SHA ` + regexp.QuoteMeta(osname + `-` + arch) + ` -->([0-9a-fA-F]{64})<!-- END SHA`)
+			if m := rx.FindStringSubmatch(release.Body); m != nil {
+				dn.CheckSum = m[1]
+			}
+			return
 		}
 	}
-	return GHDownload{}, err
+	err = fmt.Errorf("no runner tarball for %s %s in release %s", osname, arch, release.TagName)
+	return
 }
 
-func DownloadFile(name, url string) error {
-	out, err := os.Create(name)
+// FileChecksum returns the hex-encoded SHA-256 checksum of the file.
+func FileChecksum(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksum checks if the SHA-256 checksum of the file matches
+// the expected one.  Empty checksum matches any file.
+func VerifyChecksum(name, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	sum, err := FileChecksum(name)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(sum, checksum) {
+		return fmt.Errorf("%s: checksum mismatch: expected %s, got %s", name, checksum, sum)
+	}
+	return nil
+}
+
+// DownloadFile downloads the file from url and stores it under name.
+// If checksum is not empty, the SHA-256 checksum of the downloaded data
+// is verified against it.  The data are written to a temporary file,
+// which is renamed to name only if verification succeeds.
+func DownloadFile(name, url, checksum string) error {
+	out, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name) + `.*`)
 	if err != nil  {
 		return err
 	}
+	tempname := out.Name()
+	defer os.Remove(tempname)
 	defer out.Close()
 
-	resp, err := http.Get(url)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := HTTPDo(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("bad status: %s", resp.Status)
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return NewGitHubAPIError(http.MethodGet, url, resp, body)
 	}
 
-	_, err = io.Copy(out, resp.Body)
-	if err != nil  {
-		os.Remove(name)
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(out, h), resp.Body); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
 	}
-	return err
-}
 
-func GetRunnerArchive(ent entityValue) (filename string, err error) {
-	var dn GHDownload
-	if dn, err = GitHubSelectDownload(ent); err != nil {
-		return
+	if checksum != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, checksum) {
+			return fmt.Errorf("%s: checksum mismatch: expected %s, got %s", url, checksum, sum)
+		}
+	}
+
+	if err = os.Rename(tempname, name); err != nil {
+		return fmt.Errorf("can't rename %s to %s: %v", tempname, name, err)
 	}
+	return nil
+}
+
+// FetchArchive makes sure the runner archive described by dn is present
+// in the cache and returns its file name.
+func FetchArchive(dn GHDownload) (filename string, err error) {
 	filename = filepath.Join(config.CacheDir, dn.FileName)
 	_, err = os.Stat(filename)
 	switch {
 	case err == nil:
-		fmt.Printf("Using cached copy %s\n", filename)
-		break
+		if err = VerifyChecksum(filename, dn.CheckSum); err == nil {
+			fmt.Printf("Using cached copy %s\n", filename)
+			break
+		}
+		fmt.Printf("%v; removing cached copy\n", err)
+		if err = os.Remove(filename); err != nil {
+			return
+		}
+		fallthrough
 	case os.IsNotExist(err):
 		fmt.Printf("Downloading %s\n", dn.URL)
-		err = DownloadFile(filename, dn.URL)
+		err = DownloadFile(filename, dn.URL, dn.CheckSum)
 	default:
 		err = fmt.Errorf("Can't stat %s: %v", filename, err)
 	}
 	return
 }
+
+// GetRunnerArchive returns the name of the latest runner archive for
+// this host, downloading it if necessary.  The list of downloads is
+// obtained using the entity PAT.  If there's no PAT, the metadata of the
+// latest public runner release are used instead.  If neither is available,
+// the newest cached archive is used.
+func GetRunnerArchive(ent entityValue) (filename string, err error) {
+	osname, arch := HostPlatform()
+	var dn GHDownload
+	dn, err = GitHubSelectDownload(ent)
+	if errors.Is(err, ErrTokenNotFound) {
+		fmt.Printf("No PAT for %s; looking up the latest runner release\n", ent.PATKey())
+		dn, err = GitHubSelectReleaseDownload(osname, arch)
+	}
+	if err != nil {
+		// Fall back to the newest cached archive if GitHub can't be
+		// reached.  Errors reported by GitHub itself (e.g. a revoked
+		// PAT) must not be masked.
+		var uerr *url.Error
+		if !errors.As(err, &uerr) {
+			return
+		}
+		if arc, cerr := NewestCachedArchive(osname, arch); cerr == nil {
+			fmt.Printf("Can't get runner downloads (%v); using cached copy %s\n", err, arc.Path())
+			return arc.Path(), nil
+		}
+		return
+	}
+	return FetchArchive(dn)
+}
+
+// Expiration time of tokens that never expire.
+var NoExpiration = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+// PATInfo describes a personal access token, as reported by GitHub.
+type PATInfo struct {
+	Login string
+	// Scopes of a classic PAT.  Nil for fine-grained PATs.
+	Scopes []string
+	FineGrained bool
+	// Expiration time or NoExpiration.
+	ExpiresAt time.Time
+}
+
+// Formats of the github-authentication-token-expiration header.
+var tokenExpirationLayouts = []string{
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05 -0700",
+}
+
+func parseTokenExpiration(s string) (time.Time, error) {
+	for _, layout := range tokenExpirationLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q: unrecognized token expiration time", s)
+}
+
+// GitHubPATInfo checks that the PAT is valid for the given host and
+// returns its properties.
+func GitHubPATInfo(host, pat string) (info PATInfo, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, APIURL(host + `/user`), nil); err != nil {
+		return
+	}
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("Authorization", "token " + pat)
+	var resp *http.Response
+	if resp, err = HTTPDo(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var body []byte
+	if body, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+	if resp.StatusCode != 200 {
+		err = NewGitHubAPIError(http.MethodGet, req.URL.Path, resp, body)
+		return
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err = json.Unmarshal(body, &user); err != nil {
+		return
+	}
+	info.Login = user.Login
+
+	if scopes, ok := resp.Header["X-Oauth-Scopes"]; ok {
+		info.Scopes = []string{}
+		for _, s := range strings.Split(strings.Join(scopes, ","), ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				info.Scopes = append(info.Scopes, s)
+			}
+		}
+	} else {
+		info.FineGrained = true
+	}
+
+	info.ExpiresAt = NoExpiration
+	if exp := resp.Header.Get("Github-Authentication-Token-Expiration"); exp != "" {
+		info.ExpiresAt, err = parseTokenExpiration(exp)
+	}
+	return
+}
+
+// Classic PAT scopes sufficient for managing runners of each entity type.
+var requiredPATScopes = map[int][]string{
+	EntityEnterprise: {`manage_runners:enterprise`, `admin:enterprise`},
+	EntityOrg: {`admin:org`},
+	EntityRepo: {`repo`},
+}
+
+// CheckScopes verifies that the classic PAT has the scope needed to
+// manage runners of the entity.
+func (info PATInfo) CheckScopes(ent entityValue) error {
+	if info.FineGrained {
+		return nil
+	}
+	for _, s := range info.Scopes {
+		for _, r := range requiredPATScopes[ent.Type] {
+			if s == r {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("token lacks the %s scope required for %s", requiredPATScopes[ent.Type][0], ent.PATKey())
+}
+
+// GitHubCheckRunnerAccess verifies that the token allows to manage runners
+// of the entity, by requesting a registration token.  Listing runners is
+// not enough: it requires only read access.  Fine-grained PATs need the
+// "Self-hosted runners" (organizations) or "Administration" (repositories)
+// permission with read and write access.
+func GitHubCheckRunnerAccess(ent entityValue, pat string) error {
+	var token GHToken
+	if err := GitHubAPI(http.MethodPost, ent.TokenKey(RegistrationToken), pat, nil, &token); err != nil {
+		return fmt.Errorf("can't manage runners of %s: %v", ent.BaseKey(), err)
+	}
+	return nil
+}
@@ -9,6 +9,9 @@ import (
 	"os"
 	"os/exec"
 	"fmt"
+	"io"
+	"bytes"
+	"sync"
 	"path/filepath"
 	"log"
 	"strings"
@@ -22,64 +25,239 @@ import (
 	"github.com/pborman/getopt/v2"
 //?	"gopkg.in/yaml.v2"
 	"net/url"
+	"io/ioutil"
+	"encoding/json"
 )
 
-func InstallToDir(arc, projectName, projectUrl, projectToken string, opts []string) error {
-	dirname := filepath.Join(config.RunnersDir, projectName)
+// ExtractRunner extracts the runner archive arc into the directory
+// dirname, creating it if necessary.
+func ExtractRunner(arc, dirname string, out io.Writer) error {
 	if err := os.MkdirAll(dirname, 0750); err != nil {
 		return fmt.Errorf("Can't create %s: %v", dirname, err)
 	}
 
-	fmt.Printf("Extracting to %s\n", dirname)
+	fmt.Fprintf(out, "Extracting to %s\n", dirname)
+	if config.Tar == "" {
+		if err := ExtractTarGz(arc, dirname, out); err != nil {
+			return fmt.Errorf("Can't extract %s: %v", arc, err)
+		}
+		return WriteArchiveMarker(dirname, arc)
+	}
 	cmd := exec.Command(config.Tar, "-C", dirname, "-x", "-f", arc)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = out
+	cmd.Stderr = out
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("Error running %s: %v", config.Tar, err)
 	}
+	return WriteArchiveMarker(dirname, arc)
+}
 
-	if cwd, err := os.Getwd(); err != nil {
-		return fmt.Errorf("Can't get cwd: %v", err)
-	} else {
-		defer os.Chdir(cwd)
+var entityTypeName = []string{
+	`enterprise`,
+	`org`,
+	`repo`,
+}
+
+var slugRx = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Expands runner_name_template for the runner of the entity with the
+// given ordinal.
+func expandRunnerName(ent entityValue, ordinal interface{}, labels []string) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("Can't determine hostname: %v", err)
 	}
-	if err := os.Chdir(dirname); err != nil {
-		return fmt.Errorf("Can't chdir to %s: %v", dirname, err)
+
+	tmpl, err := template.New("name").Funcs(template.FuncMap{
+		"Hostname": func () string { return hostname },
+		"Ordinal": func () interface{} { return ordinal },
+		"EntityType": func () string { return entityTypeName[ent.Type] },
+		"EntityName": func () string { return ent.Name },
+		"Labels": func () []string { return labels },
+		"Slug": func (s string) string { return slugRx.ReplaceAllString(s, `-`) },
+		"Config": func () *Config { return &config },
+	}).Parse(config.RunnerNameTemplate)
+	if err != nil {
+		return "", err
 	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, nil); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
 
-	hostname, err := os.Hostname()
+// RunnerName returns the name under which the runner from the directory
+// projectName is to be registered at GitHub.  The name is created by
+// expanding the runner_name_template.
+func RunnerName(projectName string, labels []string) (string, error) {
+	ent, num, err := ParseRunnerName(projectName)
 	if err != nil {
-		return fmt.Errorf("Can't determine hostname: %v", err)
+		return "", err
 	}
+	name, err := expandRunnerName(ent, num, labels)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", fmt.Errorf("%s: runner name template expands to empty string", projectName)
+	}
+	return name, nil
+}
+
+// RunnerNameRegexp returns a regular expression matching names that
+// runner_name_template produces for runners of the entity on this host.
+func RunnerNameRegexp(ent entityValue) (*regexp.Regexp, error) {
+	const placeholder = "\x00"
+	name, err := expandRunnerName(ent, placeholder, nil)
+	if err != nil {
+		return nil, err
+	}
+	rx := strings.ReplaceAll(regexp.QuoteMeta(name), placeholder, `\d+`)
+	return regexp.Compile(`^` + rx + `$`)
+}
+
+// RegisteredRunnerName returns the name under which the runner in the
+// directory dirname is registered at GitHub.
+func RegisteredRunnerName(dirname, projectName string) (string, error) {
+	if rs, err := ReadRunnerSettings(dirname); err == nil && rs.AgentName != "" {
+		return rs.AgentName, nil
+	}
+	if es, err := ReadEphemeralSettings(dirname); err == nil && es.Name != "" {
+		return es.Name, nil
+	}
+	return RunnerName(projectName, nil)
+}
 
-	name := hostname + `_` + filepath.Base(projectName)
+// CheckRunnerNames verifies that none of the names is already used by
+// a runner registered for the entity.
+func CheckRunnerNames(ent entityValue, names []string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if seen[name] {
+			return fmt.Errorf("runner name %s generated more than once; check runner_name_template", name)
+		}
+		seen[name] = true
+	}
 
-	fmt.Printf("Configuring %s\n", name)
+	pat, err := GetToken(ent.PATKey())
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			log.Printf("no PAT for %s; can't check runner names for duplicates", ent.PATKey())
+			return nil
+		}
+		return err
+	}
+	runners, err := GitHubListRunners(ent, pat)
+	if err != nil {
+		return err
+	}
+	for _, r := range runners {
+		if seen[r.Name] {
+			return fmt.Errorf("runner %s is already registered for %s", r.Name, ent.BaseKey())
+		}
+	}
+	return nil
+}
+
+// Returns the environment for running config.sh.  The runner's .env
+// is not yet set up at that point, so HTTP settings are passed in the
+// environment.
+func runnerConfigEnv() []string {
+	env := os.Environ()
+	for _, v := range RunnerHTTPEnv() {
+		env = append(env, v[0] + `=` + v[1])
+	}
+	return env
+}
+
+// ConfigureRunner runs config.sh to register the runner extracted in
+// the directory dirname.
+func ConfigureRunner(dirname, runnerName, projectUrl, projectToken string, opts []string, out io.Writer) error {
+	fmt.Fprintf(out, "Configuring %s\n", runnerName)
 	cmdline := append([]string{
-		"--name", name,
+		"--name", runnerName,
 		"--url", projectUrl,
 		"--token", projectToken,
 		"--unattended",
 	},
 		opts...)
 	//fmt.Println(cmdline)
-	cmd = exec.Command("./config.sh", cmdline...)
-
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd := exec.Command("./config.sh", cmdline...)
+	// Don't chdir: runners may be installed in parallel
+	cmd.Dir = dirname
+	cmd.Env = runnerConfigEnv()
+	cmd.Stdout = out
+	cmd.Stderr = out
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("Error running config.sh: %v", err)
 	}
-
 	return nil
 }
 
+func InstallToDir(arc, projectName, runnerName, projectUrl, projectToken string, ro RunnerOptions, out io.Writer) error {
+	dirname := filepath.Join(config.RunnersDir, projectName)
+	if err := ExtractRunner(arc, dirname, out); err != nil {
+		return err
+	}
+	if err := ConfigureRunner(dirname, runnerName, projectUrl, projectToken, ro.ConfigOpts(), out); err != nil {
+		return err
+	}
+	if err := WriteRunnerOptions(dirname, ro); err != nil {
+		return err
+	}
+	return SetupRunnerEnv(projectName)
+}
+
+type InstallResult struct {
+	Name string
+	Output bytes.Buffer
+	Err error
+}
+
+// InstallRunners calls install for each runner name, running at most jobs
+// installations simultaneously.  When more than one runner is requested,
+// the output of each installation is collected in the Output field of its
+// result, instead of being printed.
+func InstallRunners(names []string, jobs int, install func (string, io.Writer) error) []*InstallResult {
+	results := make([]*InstallResult, len(names))
+	for i, name := range names {
+		results[i] = &InstallResult{Name: name}
+	}
+
+	if len(names) == 1 {
+		results[0].Err = install(names[0], os.Stdout)
+		return results
+	}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+	queue := make(chan *InstallResult)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for res := range queue {
+				fmt.Printf("Installing %s\n", res.Name)
+				res.Err = install(res.Name, &res.Output)
+			}
+		}()
+	}
+	for _, res := range results {
+		queue <- res
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
 func ExpandTemplate(text, runnerName string) (string, error) {
 	tmpl, err := template.New("component").Funcs(template.FuncMap{
 		"RunnerName": func () string { return runnerName },
 		"Config": func () *Config { return &config },
+		"Ghb": func () (string, error) { return os.Executable() },
 	}).Parse(text)
 	if err != nil {
 		return "", err
@@ -223,6 +401,179 @@ func ListAction(args []string) {
 	}
 }
 
+type AddOptions struct {
+	URL string
+	Token string
+	Labels string
+	RunnerGroup string
+	Count int
+	Jobs int
+	Ephemeral bool
+	Archive string
+}
+
+// AddRunners installs opts.Count new runners for the entity and adds them
+// to the pies configuration pc.  The configuration is not saved.  Returns
+// the installation results for each runner.  Runners that failed to
+// install are deregistered and their directories removed.  A non-nil
+// error is returned only if no installation has been attempted.
+func AddRunners(ent entityValue, pc *PiesConfig, opts AddOptions) ([]*InstallResult, error) {
+	if opts.URL == "" {
+		opts.URL = ent.ProjectURL("")
+	}
+
+	if opts.Ephemeral {
+		// Ephemeral runners re-register after each job, which a
+		// registration token (valid for one hour) can't provide for.
+		if opts.Token != "" {
+			return nil, errors.New("--token can't be used with ephemeral runners")
+		}
+		if _, err := GetToken(ent.PATKey()); err != nil {
+			if errors.Is(err, ErrTokenNotFound) {
+				return nil, fmt.Errorf("ephemeral runners require a PAT or GitHub App for %s", ent.PATKey())
+			}
+			return nil, err
+		}
+	} else if opts.Token == "" {
+		var err error
+		opts.Token, err = GetToken(ent.TokenKey(RegistrationToken))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n := 0
+	r, ok := pc.Runners[ent.BaseKey()]
+	if ok {
+		n = r[len(r)-1].Num + 1
+	}
+
+	labels := splitLabels([]string{opts.Labels})
+
+	names := make([]string, opts.Count)
+	runnerNames := make(map[string]string)
+	var regNames []string
+	for i := range names {
+		names[i] = filepath.Join(ent.BaseKey(), strconv.Itoa(n + i))
+		name, err := RunnerName(names[i], labels)
+		if err != nil {
+			return nil, err
+		}
+		runnerNames[names[i]] = name
+		regNames = append(regNames, name)
+		// Leftovers of a runner that could not be removed
+		dirname := filepath.Join(config.RunnersDir, names[i])
+		if _, err := os.Stat(dirname); err == nil {
+			return nil, fmt.Errorf("%s: directory %s already exists", names[i], dirname)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if err := CheckRunnerNames(ent, regNames); err != nil {
+		return nil, err
+	}
+
+	arcfile := opts.Archive
+	var err error
+	if arcfile == "" {
+		if arcfile, err = GetRunnerArchive(ent); err != nil {
+			return nil, err
+		}
+	} else if arcfile, err = filepath.Abs(arcfile); err != nil {
+		return nil, err
+	} else if _, err := os.Stat(arcfile); err != nil {
+		return nil, err
+	}
+
+	var results []*InstallResult
+	tmpl := config.ComponentTemplate
+	if opts.Ephemeral {
+		results = InstallRunners(names, opts.Jobs, func (name string, out io.Writer) error {
+			es := EphemeralSettings{
+				Name: runnerNames[name],
+				URL: opts.URL,
+				Labels: labels,
+				RunnerGroup: opts.RunnerGroup,
+			}
+			return InstallEphemeral(arcfile, name, es, out)
+		})
+		tmpl = config.EphemeralComponentTemplate
+	} else {
+		ro := RunnerOptions{Labels: labels, RunnerGroup: opts.RunnerGroup}
+		results = InstallRunners(names, opts.Jobs, func (name string, out io.Writer) error {
+			return InstallToDir(arcfile, name, runnerNames[name], opts.URL, opts.Token, ro, out)
+		})
+	}
+
+	for _, res := range results {
+		if res.Err == nil {
+			res.Err = pc.AddRunnerFromTemplate(res.Name, tmpl)
+		}
+		if res.Err != nil {
+			if err := removeFailedRunner(ent, res.Name); err != nil {
+				log.Printf("%s: %v", res.Name, err)
+			}
+		}
+	}
+	return results, nil
+}
+
+// Removes the leftovers of the runner projectName, whose installation has
+// failed: deregisters the runner, if config.sh has registered it, and
+// removes its directory.
+func removeFailedRunner(ent entityValue, projectName string) error {
+	dirname := filepath.Join(config.RunnersDir, projectName)
+	if _, err := os.Stat(filepath.Join(dirname, `.runner`)); err == nil {
+		token, err := GetToken(ent.TokenKey(RemoveToken))
+		if err == nil {
+			err = RemoveRunner(dirname, token)
+		}
+		if err == nil {
+			return nil
+		}
+		log.Printf("%s: can't deregister: %v; run `ghb sync --fix` to remove the registration", projectName, err)
+	}
+	if err := os.RemoveAll(dirname); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", dirname, err)
+	}
+	return nil
+}
+
+// ReportInstallResults prints the result of installation of each runner,
+// followed by the output of the failed installations.  Returns the number
+// of failed installations.
+func ReportInstallResults(results []*InstallResult) (failed int) {
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		}
+	}
+
+	if len(results) == 1 {
+		if failed > 0 {
+			log.Print(results[0].Err)
+		}
+		return
+	}
+
+	fmt.Println("Installation results:")
+	for _, res := range results {
+		if res.Err == nil {
+			fmt.Printf("  %s: OK\n", res.Name)
+		} else {
+			fmt.Printf("  %s: %v\n", res.Name, res.Err)
+		}
+	}
+	for _, res := range results {
+		if res.Err != nil && res.Output.Len() > 0 {
+			fmt.Printf("\nOutput from %s:\n", res.Name)
+			os.Stdout.Write(res.Output.Bytes())
+		}
+	}
+	return
+}
+
 func AddAction(args []string) {
 	ReadConfig()
 	FinalizeConfig()
@@ -231,26 +582,31 @@ func AddAction(args []string) {
 
 	var (
 		ProjectName string
-		ProjectUrl string
-		ProjectToken string
-		labels string
-		runnergroup string
+		opts = AddOptions{Count: 1, Jobs: 4}
 	)
-	optset.FlagLong(&ProjectUrl, "url", 'u', "Project URL", "URL")
-	optset.FlagLong(&ProjectToken, "token", 't', "Project token", "STRING")
-	optset.FlagLong(&labels, "labels", 'l', "Extra labels in addition to the default", "STRING")
-	optset.FlagLong(&runnergroup, "runnergroup", 'g', "Name of the runner group", "STRING")
+	optset.FlagLong(&opts.URL, "url", 'u', "Project URL", "URL")
+	optset.FlagLong(&opts.Token, "token", 't', "Project token", "STRING")
+	optset.FlagLong(&opts.Labels, "labels", 'l', "Extra labels in addition to the default", "STRING")
+	optset.FlagLong(&opts.RunnerGroup, "runnergroup", 'g', "Name of the runner group", "STRING")
+	optset.FlagLong(&opts.Count, "count", 'n', "Number of runners to add", "N")
+	optset.FlagLong(&opts.Jobs, "jobs", 'j', "Number of runners to install in parallel", "N")
+	optset.FlagLong(&opts.Ephemeral, "ephemeral", 'e', "Add ephemeral runners, re-registered after each job")
+	optset.FlagLong(&opts.Archive, "archive", 'a', "Install from the given runner archive", "FILE")
 	optset.Parse()
 
+	if opts.Count < 1 {
+		log.Fatal("--count must be a positive number")
+	}
+
 	args = optset.Args()
 	switch len(args) {
 	case 0:
 		if optset.Entity.Type == EntityRepo {
 			if n := strings.Index(optset.Entity.Name, `/`); n != -1 {
 				ProjectName = optset.Entity.Name[n+1:]
-			} else if ProjectUrl == "" {
+			} else if opts.URL == "" {
 				log.Fatalf("for --repo either --url or PROJECTNAME must be given; try `%s --help' for assistance", optset.Command)
-			} else if u, err := url.Parse(ProjectUrl); err != nil {
+			} else if u, err := url.Parse(opts.URL); err != nil {
 				log.Fatal(err)
 			} else {
 				ProjectName = u.Path
@@ -276,74 +632,113 @@ func AddAction(args []string) {
 		}
 	}
 
-	if ProjectUrl == "" {
-		ProjectUrl = optset.Entity.ProjectURL(ProjectName)
-	}
-
-	if ProjectToken == "" {
-		var err error
-		ProjectToken, err = GetToken(optset.Entity.TokenKey(RegistrationToken))
-		if err != nil {
-			log.Fatal(err)
-		}
+	lock, err := LockRoot()
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer lock.Unlock()
 
 	pc, err := ParsePiesConfig(config.PiesConfigFile)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	n := 0
-	r, ok := pc.Runners[optset.Entity.BaseKey()]
-	if ok {
-		n = r[len(r)-1].Num + 1
-	}
-
-	name := filepath.Join(optset.Entity.BaseKey(), strconv.Itoa(n))
-	// FIXME: check if dirname exists?
-
-	arcfile, err := GetRunnerArchive(optset.Entity)
+	results, err := AddRunners(optset.Entity, pc, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	failed := ReportInstallResults(results)
 
-	opts := []string{}
-	if labels != "" {
-		opts = append(opts, "--labels", labels)
-	}
-	if runnergroup != "" {
-		opts = append(opts, "--runnergroup", runnergroup)
+	if failed < len(results) {
+		if err := pc.Save(); err != nil {
+			log.Fatal(err)
+		}
+
+		if err := PiesReloadConfig(pc.ControlURL); err != nil {
+			log.Fatalf("Pies configuration updated, but pies not reloaded: %v", err)
+		}
 	}
-	if err := InstallToDir(arcfile, name, ProjectUrl, ProjectToken, opts); err != nil {
-		log.Fatal(err)
+
+	if failed > 0 {
+		if len(results) > 1 {
+			log.Printf("%d of %d runners failed to install", failed, len(results))
+		}
+		os.Exit(1)
 	}
+}
 
-	if err := pc.AddRunner(name); err != nil {
-		log.Fatal(err)
+// Runner settings, as stored by config.sh in the .runner file
+type RunnerSettings struct {
+	AgentID int          `json:"agentId"`
+	AgentName string     `json:"agentName"`
+	PoolID int           `json:"poolId"`
+	ServerURL string     `json:"serverUrl"`
+	GitHubURL string     `json:"gitHubUrl"`
+	WorkFolder string    `json:"workFolder"`
+	Ephemeral bool       `json:"ephemeral"`
+}
+
+// ReadRunnerSettings reads the .runner file from the runner directory.
+func ReadRunnerSettings(dirname string) (rs RunnerSettings, err error) {
+	var js []byte
+	if js, err = ioutil.ReadFile(filepath.Join(dirname, `.runner`)); err == nil {
+		// The file is written with a byte order mark
+		js = bytes.TrimPrefix(js, []byte("\xef\xbb\xbf"))
+		err = json.Unmarshal(js, &rs)
 	}
+	return
+}
 
-	if err := pc.Save(); err != nil {
-		log.Fatal(err)
+// Name of the file in the runner directory keeping the options the runner
+// was registered with, so that they can be restored when it is registered
+// anew.
+const RunnerOptionsFile = `.ghb-options`
+
+type RunnerOptions struct {
+	Labels []string     `json:"labels,omitempty"`
+	RunnerGroup string  `json:"runnergroup,omitempty"`
+}
+
+// ConfigOpts returns config.sh options corresponding to ro.
+func (ro RunnerOptions) ConfigOpts() []string {
+	opts := []string{}
+	if len(ro.Labels) > 0 {
+		opts = append(opts, "--labels", strings.Join(ro.Labels, ","))
+	}
+	if ro.RunnerGroup != "" {
+		opts = append(opts, "--runnergroup", ro.RunnerGroup)
 	}
+	return opts
+}
 
-	if err := PiesReloadConfig(pc.ControlURL); err != nil {
-		log.Fatalf("Pies configuration updated, but pies not reloaded: %v", err)
+// ReadRunnerOptions reads registration options from the runner directory.
+// Runners installed by older versions of ghb have no options file: empty
+// options are returned for them.
+func ReadRunnerOptions(dirname string) (ro RunnerOptions, err error) {
+	var js []byte
+	if js, err = ioutil.ReadFile(filepath.Join(dirname, RunnerOptionsFile)); err == nil {
+		err = json.Unmarshal(js, &ro)
+	} else if os.IsNotExist(err) {
+		err = nil
 	}
+	return
 }
 
-func RemoveRunner(dirname, token string) error {
-	cwd, err := os.Getwd()
+func WriteRunnerOptions(dirname string, ro RunnerOptions) error {
+	js, err := json.Marshal(ro)
 	if err != nil {
-		return fmt.Errorf("can't get cwd: %v", err)
+		return err
 	}
-	defer os.Chdir(cwd)
-
-	if err := os.Chdir(dirname); err != nil {
-		return fmt.Errorf("can't chdir to %s: %v", dirname, err)
+	filename := filepath.Join(dirname, RunnerOptionsFile)
+	if err := ioutil.WriteFile(filename, js, 0640); err != nil {
+		return fmt.Errorf("can't write %s: %v", filename, err)
 	}
+	return nil
+}
 
+func RemoveRunner(dirname, token string) error {
 	cmd := exec.Command("./config.sh", "remove", "--token", token)
-
+	cmd.Dir = dirname
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -351,31 +746,71 @@ func RemoveRunner(dirname, token string) error {
 		return err
 	}
 
-	if err := os.Chdir(cwd); err != nil {
-		return fmt.Errorf("can't chdir to %s: %v", cwd, err)
-	}
-
 	if err := os.RemoveAll(dirname); err != nil {
 		return fmt.Errorf("failed to remove %s: %v", dirname, err)
 	}
 	return nil
 }
 
+type DeleteOptions struct {
+	Keep bool
+	Force bool
+	Token string
+}
+
+// DeleteRunner deregisters the runner num of the entity, removes its
+// directory and its component from the pies configuration pc.  The
+// configuration is not saved.  The removal token, if obtained, is stored
+// in opts for use by subsequent calls.
+func DeleteRunner(ent entityValue, pc *PiesConfig, num int, opts *DeleteOptions) error {
+	r, ok := pc.Runners[ent.BaseKey()]
+	if !ok {
+		return fmt.Errorf("found no runners for %s", ent.BaseKey())
+	}
+	i := sort.Search(len(r), func(i int) bool { return r[i].Num >= num })
+	if !(i < len(r) && r[i].Num == num) {
+		return fmt.Errorf("%s: no runner %d", ent.BaseKey(), num)
+	}
+
+	var err error
+	if opts.Keep {
+		// Nothing to do
+	} else if IsEphemeralRunner(r[i].Dir) {
+		name := filepath.Join(ent.BaseKey(), strconv.Itoa(num))
+		err = RemoveEphemeralRunner(ent, name, r[i].Dir)
+	} else {
+		if opts.Token == "" {
+			opts.Token, err = GetToken(ent.TokenKey(RemoveToken))
+			if err != nil {
+				return err
+			}
+		}
+		err = RemoveRunner(r[i].Dir, opts.Token)
+	}
+	if err != nil {
+		if !opts.Force {
+			return fmt.Errorf("failed to remove runner: %v", err)
+		}
+		log.Printf("failed to remove runner: %v", err)
+		log.Printf("continuing anyway")
+	}
+
+	return pc.DeleteRunner(ent.BaseKey(), num)
+}
+
 func DeleteAction(args []string) {
 	ReadConfig()
 	FinalizeConfig()
 	optset := NewEntityOptset(args)
 	optset.SetParameters("[PROJECTNAME]")
 	var (
-		keep bool
-		force bool
-		token string
+		opts DeleteOptions
 		runnerNum = -1
 		projectName string
 	)
-	optset.FlagLong(&keep, "keep", 'k', "Keep the configured runner directory")
-	optset.FlagLong(&force, "force", 'f', "Force removal of the runner directory")
-	optset.FlagLong(&token, "token", 0, "Removal token", "STRING")
+	optset.FlagLong(&opts.Keep, "keep", 'k', "Keep the configured runner directory")
+	optset.FlagLong(&opts.Force, "force", 'f', "Force removal of the runner directory")
+	optset.FlagLong(&opts.Token, "token", 0, "Removal token", "STRING")
 	optset.FlagLong(&runnerNum, "id", 'i', "Runner ID", "NUMBER")
 	optset.Parse()
 
@@ -409,17 +844,15 @@ func DeleteAction(args []string) {
 		}
 	}
 
-	if force && keep {
+	if opts.Force && opts.Keep {
 		log.Fatal("--force and --keep can't be used together")
 	}
 
-	if token == "" && !keep {
-		var err error
-		token, err = GetToken(optset.Entity.TokenKey(RemoveToken))
-		if err != nil {
-			log.Fatal(err)
-		}
+	lock, err := LockRoot()
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer lock.Unlock()
 
 	pc, err := ParsePiesConfig(config.PiesConfigFile)
 	if err != nil {
@@ -431,34 +864,14 @@ func DeleteAction(args []string) {
 		log.Fatalf("found no runners for %s", optset.Entity.BaseKey())
 	}
 
-	var i int
-
 	if runnerNum == -1 {
-		i = len(r) - 1
-		runnerNum = r[i].Num
+		runnerNum = r[len(r) - 1].Num
 		fmt.Printf("Removing runner %s/%d\n", optset.Entity.BaseKey(), runnerNum)
-	} else {
-		i = sort.Search(len(r), func(i int) bool { return r[i].Num >= runnerNum })
-		if !(i < len(r) && r[i].Num == runnerNum) {
-			log.Fatalf("%s: no runner %d", optset.Entity.BaseKey(), runnerNum)
-		}
 	}
 
-	if token != "" {
-		if err := RemoveRunner(r[i].Dir, token); err != nil {
-			log.Printf("failed to remove runner: %v", err)
-			if force {
-				log.Printf("continuing anyway")
-			}
-			os.Exit(1)
-		}
-	}
-
-	n := r[i].TokenEnd + 1
-	if pc.Tokens[n].Text == "\n" {
-		n += 1
+	if err := DeleteRunner(optset.Entity, pc, runnerNum, &opts); err != nil {
+		log.Fatal(err)
 	}
-	pc.Tokens = append(pc.Tokens[:r[i].TokenStart], pc.Tokens[n:]...)
 
 	if err := pc.Save(); err != nil {
 		log.Fatal(err)
@@ -468,6 +881,128 @@ func DeleteAction(args []string) {
 	}
 }
 
+func ScaleAction(args []string) {
+	ReadConfig()
+	FinalizeConfig()
+	optset := NewEntityOptset(args)
+	optset.SetParameters("TARGET")
+	var (
+		addOpts = AddOptions{Jobs: 4}
+		delOpts DeleteOptions
+		dryRun bool
+	)
+	optset.FlagLong(&addOpts.Labels, "labels", 'l', "Extra labels for new runners", "STRING")
+	optset.FlagLong(&addOpts.RunnerGroup, "runnergroup", 'g', "Runner group for new runners", "STRING")
+	optset.FlagLong(&addOpts.Jobs, "jobs", 'j', "Number of runners to install in parallel", "N")
+	optset.FlagLong(&addOpts.Ephemeral, "ephemeral", 'e', "Add ephemeral runners")
+	optset.FlagLong(&delOpts.Force, "force", 'f', "Force removal of runners that can't be deregistered")
+	optset.FlagLong(&dryRun, "dry-run", 'n', "Print the plan and exit")
+	optset.Parse()
+
+	args = optset.Args()
+	if len(args) != 1 {
+		log.Fatalf("bad number of arguments; try `%s --help' for assistance", optset.Command)
+	}
+	target, err := strconv.Atoi(args[0])
+	if err != nil || target < 0 {
+		log.Fatalf("%s: invalid target number of runners", args[0])
+	}
+
+	if optset.Entity.Type == EntityRepo && strings.Index(optset.Entity.Name, `/`) == -1 {
+		log.Fatal("--repo requires full repository name (OWNER/REPO)")
+	}
+
+	lock, err := LockRoot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	pc, err := ParsePiesConfig(config.PiesConfigFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	key := optset.Entity.BaseKey()
+	r := pc.Runners[key]
+	fmt.Printf("%s: %d runners configured, target %d\n", key, len(r), target)
+
+	switch {
+	case target == len(r):
+		fmt.Println("Nothing to do")
+		return
+
+	case target > len(r):
+		addOpts.Count = target - len(r)
+		next := 0
+		if len(r) > 0 {
+			next = r[len(r)-1].Num + 1
+		}
+		fmt.Printf("Will add %d runners:", addOpts.Count)
+		for i := 0; i < addOpts.Count; i++ {
+			fmt.Printf(" %d", next + i)
+		}
+		fmt.Println()
+		if dryRun {
+			return
+		}
+
+		results, err := AddRunners(optset.Entity, pc, addOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		failed := ReportInstallResults(results)
+		if failed == len(results) {
+			os.Exit(1)
+		}
+		if err := pc.Save(); err != nil {
+			log.Fatal(err)
+		}
+		if err := PiesReloadConfig(pc.ControlURL); err != nil {
+			log.Fatalf("Pies configuration updated, but pies not reloaded: %v", err)
+		}
+		if failed > 0 {
+			log.Fatalf("%d of %d runners failed to install", failed, len(results))
+		}
+
+	default:
+		// Remove runners with highest ordinals first
+		var nums []int
+		for i := len(r) - 1; i >= target; i-- {
+			nums = append(nums, r[i].Num)
+		}
+		fmt.Printf("Will remove %d runners:", len(nums))
+		for _, n := range nums {
+			fmt.Printf(" %d", n)
+		}
+		fmt.Println()
+		if dryRun {
+			return
+		}
+
+		removed := 0
+		for _, n := range nums {
+			fmt.Printf("Removing runner %s/%d\n", key, n)
+			if err := DeleteRunner(optset.Entity, pc, n, &delOpts); err != nil {
+				log.Print(err)
+				break
+			}
+			removed++
+		}
+		if removed > 0 {
+			if err := pc.Save(); err != nil {
+				log.Fatal(err)
+			}
+			if err := PiesReloadConfig(pc.ControlURL); err != nil {
+				log.Fatalf("Pies configuration updated, but pies not reloaded: %v", err)
+			}
+		}
+		if removed < len(nums) {
+			log.Fatalf("removed %d of %d runners", removed, len(nums))
+		}
+	}
+}
+
 func CheckConfigAction(args []string) {
 	optset := NewOptset(args)
 	optset.SetParameters("")
@@ -542,6 +1077,12 @@ func StatusAction(args []string) {
 			fmt.Printf("%d runners active\n", n)
 		}
 	}
+
+	if list, err := CheckTokens(config.TokenExpiryWarning); err == nil {
+		fmt.Printf("Tokens: %s\n", TokenSummary(list, config.TokenExpiryWarning))
+	} else {
+		fmt.Printf("Can't check tokens: %v\n", err)
+	}
 }
 
 func PiesStart() {
@@ -570,6 +1111,12 @@ func StartAction(args []string) {
 		log.Fatalf("configuration fails sanity checking; run `%s configcheck' for more info", os.Args[0])
 	}
 
+	lock, err := LockRoot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lock.Unlock()
+
 	if pc, err := ParsePiesConfig(config.PiesConfigFile); err == nil {
 		if err, _ := GetPiesInstanceInfo(pc.ControlURL); err == nil {
 			log.Fatalf("GNU pies supervisor is running; run `%s status` for more info", os.Args[0])
@@ -591,6 +1138,12 @@ func StopAction(args []string) {
 	}
 
 	ReadConfig()
+	lock, err := LockRoot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lock.Unlock()
+
 	pc, err := ParsePiesConfig(config.PiesConfigFile)
 	if err != nil {
 		log.Panic(err)
@@ -616,6 +1169,12 @@ func RestartAction(args []string) {
 	}
 
 	ReadConfig()
+	lock, err := LockRoot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lock.Unlock()
+
 	pc, err := ParsePiesConfig(config.PiesConfigFile)
 	if err != nil {
 		log.Panic(err)
@@ -683,11 +1242,17 @@ func SetupAction(args []string) {
 		log.Fatalf("configuration fails sanity checking; run `%s configcheck' for more info", os.Args[0])
 	}
 
+	lock, err := LockRoot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lock.Unlock()
+
 	if make_config {
 		filename := filepath.Join(GetHomeDir(), `ghb.conf`)
 		file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
-			log.Fatal("can't create %s: %v", filename, err)
+			log.Fatalf("can't create %s: %v", filename, err)
 		}
 		NormalizeRel(&config)
 		Annotate(&config, file)
@@ -721,7 +1286,9 @@ func (tv *timeValue) String() string {
 
 func (tok GHToken) Print() {
 	fmt.Printf("Token: %s\n", tok.Token)
-	if time.Now().Before(tok.ExpiresAt) {
+	if tok.ExpiresAt.Equal(NoExpiration) {
+		fmt.Printf("Expires at: never\n")
+	} else if time.Now().Before(tok.ExpiresAt) {
 		if t, err := tok.ExpiresAt.MarshalText(); err == nil {
 			fmt.Printf("Expires at: %s\n", string(t))
 		}
@@ -734,6 +1301,68 @@ func (tok GHToken) Print() {
 	}
 }
 
+// VerifyPAT checks that the token is valid and can be used to manage
+// runners of the entity.
+func VerifyPAT(ent entityValue, token string) (PATInfo, error) {
+	info, err := GitHubPATInfo(ent.Namespace(), token)
+	if err != nil {
+		return info, err
+	}
+	if info.FineGrained {
+		fmt.Printf("Fine-grained token of %s\n", info.Login)
+	} else {
+		fmt.Printf("Classic token of %s, scopes: %s\n", info.Login, strings.Join(info.Scopes, ", "))
+		if err := info.CheckScopes(ent); err != nil {
+			return info, err
+		}
+	}
+	if info.ExpiresAt.Equal(NoExpiration) {
+		fmt.Println("Token does not expire")
+	} else {
+		fmt.Printf("Token expires at %s\n", info.ExpiresAt.Format(time.RFC3339))
+	}
+
+	// Repository PATs are stored per owner; runner access can be checked
+	// only if the full repository name is given.
+	if ent.Type != EntityRepo || strings.Contains(ent.Name, `/`) {
+		if err := GitHubCheckRunnerAccess(ent, token); err != nil {
+			return info, err
+		}
+	} else if info.FineGrained {
+		log.Printf("can't verify permissions of a fine-grained token without full repository name (OWNER/REPO)")
+	}
+	return info, nil
+}
+
+// Exports tokens to the file filename ("-" for stdout).
+func exportTokensToFile(filename string, filter TokenFilter, passphrase []byte) (int, error) {
+	if filename == "-" {
+		return ExportTokens(os.Stdout, filter, passphrase)
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := ExportTokens(file, filter, passphrase)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// Imports tokens from the file filename ("-" for stdin).
+func importTokensFromFile(filename string, filter TokenFilter, passphrase []byte) (int, error) {
+	if filename == "-" {
+		return ImportTokens(os.Stdin, filter, passphrase)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return ImportTokens(file, filter, passphrase)
+}
+
 func PatAction(args []string) {
 	ReadConfig()
 	optset := NewEntityOptset(args)
@@ -743,12 +1372,107 @@ func PatAction(args []string) {
 		token string
 		delete bool
 		all bool
+		rekey bool
+		oldKeyFile string
+		oldPassphraseFile string
+		noVerify bool
+		check bool
+		window = config.TokenExpiryWarning
+		exportFile string
+		importFile string
+		filter TokenFilter
+		passphraseFile string
 	)
 	optset.FlagLong(&token, "set", 's', "Set new PAT", "STRING")
 	optset.FlagLong(&expiration, "expires", 'e', "STRING")
 	optset.FlagLong(&delete, "delete", 'd', "Delete PAT")
 	optset.FlagLong(&all, "all", 'a', "List all keys for the given entity")
-	optset.Parse()
+	optset.FlagLong(&noVerify, "no-verify", 0, "Don't verify the token with GitHub (with --set)")
+	optset.FlagLong(&check, "check", 'c', "Check expiration of all tokens")
+	optset.FlagLong(&window, "window", 'w', "Warn about tokens expiring within this interval (with --check)", "DURATION")
+	optset.FlagLong(&rekey, "rekey", 0, "Re-encrypt token database with the configured key")
+	optset.FlagLong(&oldKeyFile, "old-key-file", 0, "Key file the token database is currently encrypted with (for --rekey)", "FILE")
+	optset.FlagLong(&oldPassphraseFile, "old-passphrase-file", 0, "File with the passphrase the token database is currently encrypted with (for --rekey)", "FILE")
+	optset.FlagLong(&exportFile, "export", 0, "Export tokens to FILE", "FILE")
+	optset.FlagLong(&importFile, "import", 0, "Import tokens from FILE", "FILE")
+	optset.FlagLong(&filter.Prefix, "prefix", 0, "Export or import only keys with the given prefix", "KEY")
+	optset.FlagLong(&filter.SkipExpired, "skip-expired", 0, "Don't export or import expired tokens")
+	optset.FlagLong(&filter.SkipCached, "skip-cached", 0, "Don't export or import cached registration, remove and installation tokens")
+	optset.FlagLong(&passphraseFile, "passphrase-file", 0, "Read export file passphrase from FILE", "FILE")
+	// Entity is optional for --check, --rekey, --export and --import:
+	// don't call optset.Parse
+	optset.Optset.Parse()
+
+	modes := 0
+	for _, b := range []bool{check, rekey, exportFile != "", importFile != ""} {
+		if b {
+			modes++
+		}
+	}
+	if modes > 1 {
+		log.Fatal("--check, --rekey, --export, and --import cannot be used together")
+	}
+	if modes > 0 && (delete || token != "" || all) {
+		log.Fatal("--delete, --set, and --all cannot be used with --check, --rekey, --export, or --import")
+	}
+
+	if exportFile != "" || importFile != "" {
+		if optset.Entity.Name != "" {
+			if filter.Prefix != "" {
+				log.Fatal("--prefix cannot be used together with entity")
+			}
+			filter.Prefix = optset.Entity.PATKey()
+		}
+		passphrase, err := ExportPassphrase(passphraseFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if exportFile != "" {
+			n, err := exportTokensToFile(exportFile, filter, passphrase)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(os.Stderr, "%d tokens exported\n", n)
+		} else {
+			n, err := importTokensFromFile(importFile, filter, passphrase)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(os.Stderr, "%d tokens imported\n", n)
+		}
+		return
+	}
+
+	if optset.Entity.Name != "" && (check || rekey) {
+		log.Fatal("entity cannot be used with --check or --rekey")
+	}
+
+	if check {
+		list, err := CheckTokens(window)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if n := PrintTokenStatus(list); n > 0 {
+			log.Printf("%d PATs expired or expiring within %s", n, window)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if rekey {
+		oldSecret, err := OldTokenSecret(oldKeyFile, oldPassphraseFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := RekeyTokenDB(oldSecret); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if optset.Entity.Name == "" {
+		log.Fatal("One of --org, --enterprise, or --repo must be given")
+	}
 
 	if delete && token != "" {
 		log.Fatal("--delete and --set cannot be used together")
@@ -774,6 +1498,15 @@ func PatAction(args []string) {
 		}
 	} else {
 		exptime := time.Time(expiration)
+		if !noVerify {
+			info, err := VerifyPAT(optset.Entity, token)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !optset.IsSet("expires") {
+				exptime = info.ExpiresAt
+			}
+		}
 		tok := GHToken{Token: token, ExpiresAt: exptime}
 		if err := SaveToken(optset.Entity.PATKey(), tok); err != nil {
 			log.Fatal(err)
@@ -796,6 +1529,26 @@ func main() {
 				  Help: "Add runner"},
 		"delete":  Action{Action: DeleteAction,
 				  Help: "Delete a runner"},
+		"scale":   Action{Action: ScaleAction,
+				  Help: "Scale entity runners to the given number"},
+		"autoscale": Action{Action: AutoscaleAction,
+				    Help: "Scale runners according to the job queue"},
+		"upgrade": Action{Action: UpgradeAction,
+				  Help: "Upgrade runner software"},
+		"label":   Action{Action: LabelAction,
+				  Help: "Manage runner labels"},
+		"sync":    Action{Action: SyncAction,
+				  Help: "Reconcile local runners with GitHub"},
+		"cache":   Action{Action: CacheAction,
+				  Help: "Manage runner archive cache"},
+		"du":      Action{Action: DuAction,
+				  Help: "Show disk usage of runners"},
+		"clean":   Action{Action: CleanAction,
+				  Help: "Clean up work directories of idle runners"},
+		"env":     Action{Action: EnvAction,
+				  Help: "Manage runner environment"},
+		"hooks":   Action{Action: HooksAction,
+				  Help: "Manage job lifecycle hooks"},
 		"list":    Action{Action: ListAction,
 				  Help: "List existing runners"},
 		"configcheck": Action{Action: CheckConfigAction,
@@ -814,6 +1567,8 @@ func main() {
 				  Help: "Show a short help summary"},
 		"pat":     Action{Action: PatAction,
                                   Help: "Manage private access keys"},
+		"ephemeral": Action{Action: EphemeralAction,
+				    Help: "Register and run ephemeral runner (used by pies)"},
 	}
 
 	if len(os.Args) == 1 {
@@ -0,0 +1,173 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"net/url"
+)
+
+// ----------------------------------
+// GitHub hosts
+// ----------------------------------
+
+// Entities can be hosted on github.com or on a GitHub Enterprise Server
+// instance.  Keys of the entities hosted elsewhere than on github.com are
+// prefixed with the host name (and port, if any) of the instance, e.g.
+// "ghe.example.com/orgs/foo".  Such keys are used both as token database
+// keys and as API paths: APIURL converts them to full URLs.
+
+const (
+	DefaultGitHubURL = `https://github.com`
+	DefaultGitHubAPIURL = `https://api.github.com`
+)
+
+// DefaultAPIURL returns the API base URL for the GitHub instance with the
+// given web base URL.
+func DefaultAPIURL(web string) string {
+	u, err := url.Parse(web)
+	if err != nil {
+		return strings.TrimSuffix(web, `/`) + `/api/v3`
+	}
+	switch {
+	case u.Host == `github.com`:
+		return DefaultGitHubAPIURL
+	case strings.HasSuffix(u.Host, `.ghe.com`):
+		// GitHub Enterprise Cloud with data residency
+		return u.Scheme + `://api.` + u.Host
+	}
+	return strings.TrimSuffix(web, `/`) + `/api/v3`
+}
+
+// hostOf returns the host part of the URL.
+func hostOf(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// githubURLs returns web and API base URLs, given the global settings
+// and the entity settings ec (can be nil).
+func githubURLs(ec *EntityConfig) (web, api string) {
+	web, api = config.GitHubURL, config.GitHubAPIURL
+	if ec != nil {
+		if ec.GitHubURL != "" {
+			web, api = ec.GitHubURL, ""
+		}
+		if ec.GitHubAPIURL != "" {
+			api = ec.GitHubAPIURL
+		}
+	}
+	if web == "" {
+		web = DefaultGitHubURL
+	}
+	if api == "" {
+		api = DefaultAPIURL(web)
+	}
+	return strings.TrimSuffix(web, `/`), strings.TrimSuffix(api, `/`)
+}
+
+// GitHubURLs returns web and API base URLs for the entity.  Settings of
+// the entity itself take precedence over those of its owner (for
+// repositories), which in turn take precedence over the global ones.
+func (ent entityValue) GitHubURLs() (web, api string) {
+	ec := config.Entities[ent.BaseKey()]
+	if ec == nil || (ec.GitHubURL == "" && ec.GitHubAPIURL == "") {
+		if oc := config.Entities[ent.ownerKey()]; oc != nil {
+			ec = oc
+		}
+	}
+	return githubURLs(ec)
+}
+
+// namespaceOf returns the host namespace for the web base URL: empty
+// string for github.com, and host name otherwise.
+func namespaceOf(web string) string {
+	if host := hostOf(web); host != `github.com` {
+		return host
+	}
+	return ""
+}
+
+// Namespace returns the host prefix for the keys of the entity.
+func (ent entityValue) Namespace() string {
+	web, _ := ent.GitHubURLs()
+	return namespaceOf(web)
+}
+
+// HostKey returns the base key prefixed with the host namespace.
+func (ent entityValue) HostKey() string {
+	return ent.Namespace() + ent.BaseKey()
+}
+
+// SplitKey splits the key into the host namespace and the path.
+func SplitKey(key string) (host, path string) {
+	if strings.HasPrefix(key, `/`) {
+		return "", key
+	}
+	if n := strings.IndexByte(key, '/'); n != -1 {
+		return key[:n], key[n:]
+	}
+	return key, ""
+}
+
+// apiBaseURL returns the API base URL for the host namespace.
+func apiBaseURL(host string) string {
+	if web, api := githubURLs(nil); namespaceOf(web) == host {
+		return api
+	}
+	var keys []string
+	for key := range config.Entities {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if ec := config.Entities[key]; ec != nil && ec.GitHubURL != "" {
+			if web, api := githubURLs(ec); namespaceOf(web) == host {
+				return api
+			}
+		}
+	}
+	if host == "" {
+		return DefaultGitHubAPIURL
+	}
+	return `https://` + host + `/api/v3`
+}
+
+// checkAPIURLs verifies that the entities hosted on the same GitHub
+// instance use the same API base URL.  API endpoints are looked up by
+// the host namespace, so a differing github_api_url would be ignored.
+func checkAPIURLs() error {
+	web, api := githubURLs(nil)
+	seen := map[string]string{namespaceOf(web): api}
+	var keys []string
+	for key := range config.Entities {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ent, err := ParseEntityKey(key)
+		if err != nil {
+			return err
+		}
+		web, api := ent.GitHubURLs()
+		ns := namespaceOf(web)
+		if prev, ok := seen[ns]; ok && prev != api {
+			return fmt.Errorf("%s: API URL %s conflicts with %s used for the same host", key, api, prev)
+		}
+		seen[ns] = api
+	}
+	return nil
+}
+
+// APIURL converts the key to the full URL of the API endpoint.
+func APIURL(key string) string {
+	host, path := SplitKey(key)
+	return apiBaseURL(host) + path
+}
@@ -0,0 +1,151 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"fmt"
+	"time"
+	"sort"
+	"errors"
+	"strconv"
+	"net/http"
+	"io/ioutil"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/json"
+	"encoding/base64"
+)
+
+// ----------------------------------
+// GitHub App authentication
+// ----------------------------------
+
+// Suffix of the token database key for caching installation access
+// tokens.  The key is formed by appending it to the PAT key.
+const AppTokenSuffix = `/app/installation-token`
+
+// Installation access tokens expiring within this interval are
+// considered expired.
+const appTokenMargin = time.Minute
+
+// AppConfigFor returns the GitHub App settings that apply to the PAT
+// key.  The settings are looked up first in the entity with that key,
+// then in the entities sharing it (e.g. the repositories of the same
+// owner).
+func AppConfigFor(patkey string) *GitHubAppConfig {
+	_, basekey := SplitKey(patkey)
+	if ec := config.Entities[basekey]; ec != nil && ec.App != nil {
+		if ent, err := ParseEntityKey(basekey); err == nil && ent.PATKey() == patkey {
+			return ec.App
+		}
+	}
+	var keys []string
+	for key := range config.Entities {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ec := config.Entities[key]
+		if ec == nil || ec.App == nil {
+			continue
+		}
+		if ent, err := ParseEntityKey(key); err == nil && ent.PATKey() == patkey {
+			return ec.App
+		}
+	}
+	return nil
+}
+
+func readAppPrivateKey(filename string) (*rsa.PrivateKey, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", filename)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't parse private key: %v", filename, err)
+	}
+	if rsakey, ok := key.(*rsa.PrivateKey); ok {
+		return rsakey, nil
+	}
+	return nil, fmt.Errorf("%s: not an RSA private key", filename)
+}
+
+// AppJWT returns a JSON Web Token authenticating as the GitHub App.
+func AppJWT(app *GitHubAppConfig) (string, error) {
+	key, err := readAppPrivateKey(app.PrivateKeyFile)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		// Allow for clock drift
+		"iat": now.Add(-time.Minute).Unix(),
+		// GitHub accepts at most 10 minutes
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(app.AppID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + `.` + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + `.` + enc.EncodeToString(sig), nil
+}
+
+// GitHubInstallationToken exchanges the App JWT for an installation
+// access token on the given host.
+func GitHubInstallationToken(host string, app *GitHubAppConfig) (token GHToken, err error) {
+	var jwt string
+	if jwt, err = AppJWT(app); err != nil {
+		return
+	}
+	path := fmt.Sprintf("%s/app/installations/%d/access_tokens", host, app.InstallationID)
+	err = gitHubRequest(http.MethodPost, path, "Bearer " + jwt, nil, &token)
+	return
+}
+
+// GetAppToken returns a valid installation access token for the PAT key,
+// obtaining a new one if the cached token is missing or about to expire.
+func GetAppToken(patkey string, app *GitHubAppConfig) (string, error) {
+	key := patkey + AppTokenSuffix
+	if tok, err := FetchRawToken(key); err == nil {
+		if time.Now().Add(appTokenMargin).Before(tok.ExpiresAt) {
+			return tok.Token, nil
+		}
+	} else if !errors.Is(err, ErrTokenNotFound) {
+		return "", err
+	}
+	host, _ := SplitKey(patkey)
+	tok, err := GitHubInstallationToken(host, app)
+	if err != nil {
+		return "", fmt.Errorf("can't get installation token for %s: %v", patkey, err)
+	}
+	if err := SaveToken(key, tok); err != nil && !errors.Is(err, ErrTokenStoreReadOnly) {
+		return "", err
+	}
+	return tok.Token, nil
+}
@@ -0,0 +1,110 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"errors"
+	"sort"
+	"strconv"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Job lifecycle hooks
+// ----------------------------------
+
+func HooksAction(args []string) {
+	ReadConfig()
+	FinalizeConfig()
+	optset := NewEntityOptset(args)
+	optset.SetParameters("show|apply")
+	restart := false
+	optset.FlagLong(&restart, "restart", 'r', "Restart idle running runners to apply the changes")
+	// Entity is optional: don't call optset.Parse
+	optset.Optset.Parse()
+
+	args = optset.Args()
+	if len(args) != 1 {
+		log.Fatalf("bad number of arguments; try `%s --help' for assistance", optset.Command)
+	}
+	subcommand := args[0]
+	if subcommand != `show` && subcommand != `apply` {
+		log.Fatalf("unrecognized subcommand; try `%s --help' for assistance", optset.Command)
+	}
+
+	if subcommand == `apply` {
+		lock, err := LockRoot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer lock.Unlock()
+	}
+
+	pc, err := ParsePiesConfig(config.PiesConfigFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var keys []string
+	if optset.Entity.Name != "" {
+		keys = append(keys, optset.Entity.BaseKey())
+		if _, ok := pc.Runners[keys[0]]; !ok {
+			log.Fatalf("found no runners for %s", keys[0])
+		}
+	} else {
+		for key := range pc.Runners {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	failed := false
+	for _, key := range keys {
+		ent, err := ParseEntityKey(key)
+		if err != nil {
+			log.Print(err)
+			failed = true
+			continue
+		}
+		for _, r := range pc.Runners[key] {
+			name := filepath.Join(key, strconv.Itoa(r.Num))
+			env, err := ReadEnvFile(filepath.Join(r.Dir, `.env`))
+			if err != nil {
+				log.Printf("%s: %v", name, err)
+				failed = true
+				continue
+			}
+			if subcommand == `show` {
+				started, _ := env.Get(EnvJobStartedHook)
+				completed, _ := env.Get(EnvJobCompletedHook)
+				fmt.Printf("%s: started=%s completed=%s\n", name, started, completed)
+				continue
+			}
+
+			ApplyHooks(ent, env)
+			if err := env.Save(); err != nil {
+				log.Printf("%s: %v", name, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("%s: updated\n", name)
+			if restart {
+				if err := RestartIdleRunner(ent, pc.ControlURL, name); errors.Is(err, ErrRunnerBusy) {
+					fmt.Printf("%s: busy, restart pending\n", name)
+				} else if err != nil {
+					log.Printf("%s: can't restart: %v", name, err)
+					failed = true
+				}
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
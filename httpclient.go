@@ -0,0 +1,221 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"strings"
+	"unicode"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// ----------------------------------
+// HTTP client
+// ----------------------------------
+
+// HTTP client settings.  These apply to the GitHub API requests and
+// runner downloads, and are passed to the runners (see RunnerHTTPEnv).
+type HTTPConfig struct {
+	// Proxy URL, optionally with user name and password.  If empty,
+	// proxy is taken from the environment (https_proxy, etc.).
+	Proxy string          `yaml:"proxy,omitempty"`
+	// Comma-separated list of hosts that are accessed directly.
+	NoProxy string        `yaml:"no_proxy,omitempty"`
+	// File with additional trusted CA certificates in PEM format.
+	CAFile string         `yaml:"ca_file,omitempty"`
+	// Client certificate and key in PEM format.  If ClientKey is empty,
+	// the key is read from ClientCert.
+	ClientCert string      `yaml:"client_cert,omitempty"`
+	ClientKey string       `yaml:"client_key,omitempty"`
+}
+
+func (hc HTTPConfig) proxyURL() (*url.URL, error) {
+	s := hc.Proxy
+	if !strings.Contains(s, `://`) {
+		s = `http://` + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	switch u.Scheme {
+	case `http`, `https`, `socks5`:
+	default:
+		return nil, fmt.Errorf("%s: unsupported proxy scheme", hc.Proxy)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%s: proxy host missing", hc.Proxy)
+	}
+	return u, nil
+}
+
+// BypassProxy returns true if the URL matches the no_proxy list.  Each
+// element of the list is either a "*", which matches all hosts, an IP
+// address or CIDR range, or a domain name (optionally preceded by a dot),
+// which matches that domain and its subdomains.  IP addresses and domain
+// names can be followed by ":PORT" to match only that port.
+func (hc HTTPConfig) BypassProxy(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		if u.Scheme == `http` {
+			port = `80`
+		} else {
+			port = `443`
+		}
+	}
+	ip := net.ParseIP(host)
+	for _, entry := range strings.FieldsFunc(hc.NoProxy, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if entry == `*` {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		ehost := entry
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			ehost = h
+		}
+		ehost = strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(ehost, `*`), `.`))
+		if eip := net.ParseIP(ehost); eip != nil {
+			if ip != nil && eip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if host == ehost || strings.HasSuffix(host, `.` + ehost) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hc HTTPConfig) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	proxy := http.ProxyFromEnvironment
+	if hc.Proxy != "" {
+		u, err := hc.proxyURL()
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u)
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if hc.BypassProxy(req.URL) {
+			return nil, nil
+		}
+		return proxy(req)
+	}, nil
+}
+
+func (hc HTTPConfig) tlsConfig() (*tls.Config, error) {
+	if hc.CAFile == "" && hc.ClientCert == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{}
+	if hc.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(hc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", hc.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if hc.ClientCert != "" {
+		keyfile := hc.ClientKey
+		if keyfile == "" {
+			keyfile = hc.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(hc.ClientCert, keyfile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// Transport returns the HTTP transport configured according to the
+// settings.
+func (hc HTTPConfig) Transport() (*http.Transport, error) {
+	proxy, err := hc.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+	tc, err := hc.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxy
+	if tc != nil {
+		t.TLSClientConfig = tc
+	}
+	return t, nil
+}
+
+var (
+	httpClient *http.Client
+	httpClientErr error
+	httpClientOnce sync.Once
+)
+
+// HTTPClient returns the client for requests to GitHub.
+func HTTPClient() (*http.Client, error) {
+	httpClientOnce.Do(func() {
+		var t *http.Transport
+		if t, httpClientErr = config.HTTP.Transport(); httpClientErr == nil {
+			httpClient = &http.Client{Transport: t}
+		}
+	})
+	return httpClient, httpClientErr
+}
+
+// HTTPDo sends the request using HTTPClient.
+func HTTPDo(req *http.Request) (*http.Response, error) {
+	clt, err := HTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	return clt.Do(req)
+}
+
+// RunnerHTTPEnv returns the environment variables passing the HTTP
+// settings to the runner.  The runner itself uses the system trust store,
+// so the CA file is passed only to the actions run by Node.js.  There is
+// no way to pass the client certificate.
+func RunnerHTTPEnv() (env [][2]string) {
+	hc := config.HTTP
+	if hc.Proxy != "" {
+		env = append(env,
+			[2]string{`https_proxy`, hc.Proxy},
+			[2]string{`http_proxy`, hc.Proxy})
+	}
+	if hc.NoProxy != "" {
+		env = append(env, [2]string{`no_proxy`, hc.NoProxy})
+	}
+	if hc.CAFile != "" {
+		env = append(env, [2]string{`NODE_EXTRA_CA_CERTS`, hc.CAFile})
+	}
+	return
+}
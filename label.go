@@ -0,0 +1,195 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"strconv"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Runner labels
+// ----------------------------------
+
+// Splits label arguments, each of which can be a comma-separated list.
+func splitLabels(args []string) (labels []string) {
+	for _, arg := range args {
+		for _, s := range strings.Split(arg, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				labels = append(labels, s)
+			}
+		}
+	}
+	return
+}
+
+func printLabels(name string, id int, labels []GHLabel) {
+	var sl []string
+	for _, l := range labels {
+		sl = append(sl, l.Name)
+	}
+	fmt.Printf("%s (%d): %s\n", name, id, strings.Join(sl, ", "))
+}
+
+// Returns custom labels from the list.
+func customLabels(labels []GHLabel) (result []string) {
+	for _, l := range labels {
+		if l.Type != `read-only` {
+			result = append(result, l.Name)
+		}
+	}
+	return
+}
+
+// Stores the custom labels in the settings of the ephemeral runner, so
+// that they survive re-registration.
+func updateEphemeralLabels(dirname string, labels []string) error {
+	es, err := ReadEphemeralSettings(dirname)
+	if err != nil {
+		return err
+	}
+	es.Labels = labels
+	js, err := json.Marshal(es)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dirname, EphemeralSettingsFile), js, 0640)
+}
+
+// Stores the custom labels in the registration options of the runner, so
+// that they survive re-registration by sync --fix.
+func updateRunnerLabels(dirname string, labels []string) error {
+	ro, err := ReadRunnerOptions(dirname)
+	if err != nil {
+		return err
+	}
+	ro.Labels = labels
+	return WriteRunnerOptions(dirname, ro)
+}
+
+func LabelAction(args []string) {
+	ReadConfig()
+	optset := NewEntityOptset(args)
+	optset.SetParameters("list|add|remove|set [LABEL...]")
+	runnerNum := -1
+	optset.FlagLong(&runnerNum, "id", 'i', "Runner ID (default: all runners of the entity)", "NUMBER")
+	optset.Parse()
+
+	args = optset.Args()
+	if len(args) == 0 {
+		log.Fatalf("subcommand missing; try `%s --help' for assistance", optset.Command)
+	}
+	subcommand := args[0]
+	labels := splitLabels(args[1:])
+	switch subcommand {
+	case `list`:
+		if len(labels) > 0 {
+			log.Fatalf("too many arguments; try `%s --help' for assistance", optset.Command)
+		}
+	case `add`, `remove`:
+		if len(labels) == 0 {
+			log.Fatalf("no labels given; try `%s --help' for assistance", optset.Command)
+		}
+	case `set`:
+		// Empty list removes all custom labels
+	default:
+		log.Fatalf("unrecognized subcommand; try `%s --help' for assistance", optset.Command)
+	}
+
+	if optset.Entity.Type == EntityRepo && strings.Index(optset.Entity.Name, `/`) == -1 {
+		log.Fatal("--repo requires full repository name (OWNER/REPO)")
+	}
+
+	if subcommand != `list` {
+		lock, err := LockRoot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer lock.Unlock()
+	}
+
+	pc, err := ParsePiesConfig(config.PiesConfigFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	key := optset.Entity.BaseKey()
+	r, ok := pc.Runners[key]
+	if !ok {
+		log.Fatalf("found no runners for %s", key)
+	}
+	if runnerNum != -1 {
+		i := sort.Search(len(r), func(i int) bool { return r[i].Num >= runnerNum })
+		if !(i < len(r) && r[i].Num == runnerNum) {
+			log.Fatalf("%s: no runner %d", key, runnerNum)
+		}
+		r = r[i:i+1]
+	}
+
+	pat, err := GetToken(optset.Entity.PATKey())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, runner := range r {
+		name := filepath.Join(key, strconv.Itoa(runner.Num))
+		rs, err := ReadRunnerSettings(runner.Dir)
+		if err != nil {
+			log.Printf("%s: can't get runner ID: %v", name, err)
+			failed = true
+			continue
+		}
+
+		var result []GHLabel
+		switch subcommand {
+		case `list`:
+			result, err = GitHubRunnerLabels(optset.Entity, pat, rs.AgentID)
+
+		case `add`:
+			result, err = GitHubAddRunnerLabels(optset.Entity, pat, rs.AgentID, labels)
+
+		case `set`:
+			result, err = GitHubSetRunnerLabels(optset.Entity, pat, rs.AgentID, labels)
+
+		case `remove`:
+			for _, l := range labels {
+				if result, err = GitHubRemoveRunnerLabel(optset.Entity, pat, rs.AgentID, l); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			failed = true
+			continue
+		}
+		printLabels(name, rs.AgentID, result)
+
+		if subcommand == `list` {
+			continue
+		}
+		if IsEphemeralRunner(runner.Dir) {
+			if err := updateEphemeralLabels(runner.Dir, customLabels(result)); err != nil {
+				log.Printf("%s: can't update ephemeral settings: %v", name, err)
+				failed = true
+			}
+		} else if err := updateRunnerLabels(runner.Dir, customLabels(result)); err != nil {
+			log.Printf("%s: can't update runner options: %v", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,90 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"errors"
+	"syscall"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Advisory file locks
+// ----------------------------------
+
+// Name of the lock file in the root directory.
+const RootLockFile = `ghb.lock`
+
+var ErrLocked = errors.New("locked by another process")
+
+// FileLock is an advisory lock placed on a file.  The lock is released
+// when the process terminates, even if Unlock is not called.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile places an advisory lock on filename, creating the file if
+// necessary, and waits until the lock is granted.  The lock is exclusive,
+// unless shared is true.
+func LockFile(filename string, shared bool) (*FileLock, error) {
+	return lockFile(filename, shared, false)
+}
+
+// TryLockFile is like LockFile, but returns ErrLocked instead of waiting
+// if the lock is held by another process.
+func TryLockFile(filename string, shared bool) (*FileLock, error) {
+	return lockFile(filename, shared, true)
+}
+
+func lockFile(filename string, shared, nowait bool) (*FileLock, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if nowait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("can't lock %s: %v", filename, err)
+	}
+	return &FileLock{file: file}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	// Closing the descriptor releases the lock
+	return l.file.Close()
+}
+
+// LockRoot places an exclusive lock on the ghb root directory.  The lock
+// must be held by actions that modify pies configuration, runners, or the
+// runner cache.  If another ghb process holds it, LockRoot informs the
+// user and waits until it is released.
+func LockRoot() (*FileLock, error) {
+	filename := filepath.Join(config.RootDir, RootLockFile)
+	lock, err := TryLockFile(filename, false)
+	if errors.Is(err, ErrLocked) {
+		log.Printf("waiting for another ghb process to release %s", filename)
+		lock, err = LockFile(filename, false)
+	}
+	return lock, err
+}
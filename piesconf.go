@@ -19,6 +19,7 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"time"
 	"path/filepath"
 )
 
@@ -405,6 +406,39 @@ type PiesConfig struct {
 	ControlURL *url.URL
 	Runners map[string][]Runner
 	Tokens []*Token
+	// Modification time and size of the file when it was read.  Used
+	// to detect modifications made by other processes.
+	modTime time.Time
+	size int64
+}
+
+var ErrPiesConfigChanged = errors.New("file was modified by another process since it was read")
+
+// stat records modification time and size of the file.
+func (pc *PiesConfig) stat() error {
+	st, err := os.Stat(pc.FileName)
+	if err != nil {
+		return err
+	}
+	pc.modTime = st.ModTime()
+	pc.size = st.Size()
+	return nil
+}
+
+// CheckModified returns ErrPiesConfigChanged if the file was modified
+// after it was read.
+func (pc *PiesConfig) CheckModified() error {
+	st, err := os.Stat(pc.FileName)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: %w", pc.FileName, ErrPiesConfigChanged)
+		}
+		return err
+	}
+	if !st.ModTime().Equal(pc.modTime) || st.Size() != pc.size {
+		return fmt.Errorf("%s: %w", pc.FileName, ErrPiesConfigChanged)
+	}
+	return nil
 }
 
 func (pc *PiesConfig) ParseControl(l *Lexer) error {
@@ -502,6 +536,10 @@ func (pc *PiesConfig) ParseComponent(l *Lexer) error {
 }
 
 func (pc *PiesConfig) Save() error {
+	if err := pc.CheckModified(); err != nil {
+		return fmt.Errorf("%w; changes not saved", err)
+	}
+
 	tempfile, err := ioutil.TempFile(filepath.Dir(pc.FileName), filepath.Base(pc.FileName) + `.*`)
 	if err != nil {
 		return fmt.Errorf("can't create temporary file: %v", err)
@@ -523,11 +561,16 @@ func (pc *PiesConfig) Save() error {
 		return fmt.Errorf("can't rename %s to %s: %v", tempname, pc.FileName, err)
 	}
 
-	return nil
+	return pc.stat()
 }
 
 func ParsePiesConfig(filename string) (*PiesConfig, error) {
 	pc := &PiesConfig{FileName: filename, Runners: make(map[string][]Runner)}
+	// Stat the file before reading it, so that modifications made
+	// while it is being read are detected as well.
+	if err := pc.stat(); err != nil {
+		return nil, err
+	}
 
 	l, err := LexerNew(filename)
 	if err != nil {
@@ -561,7 +604,11 @@ func ParsePiesConfig(filename string) (*PiesConfig, error) {
 }
 
 func (pc *PiesConfig) AddRunner(name string) error {
-	text, err := ExpandTemplate(config.ComponentTemplate, name)
+	return pc.AddRunnerFromTemplate(name, config.ComponentTemplate)
+}
+
+func (pc *PiesConfig) AddRunnerFromTemplate(name, template string) error {
+	text, err := ExpandTemplate(template, name)
 	if err != nil {
 		return err
 	}
@@ -577,5 +624,54 @@ func (pc *PiesConfig) AddRunner(name string) error {
 	//	}
 	// }
 	// pc.Tokens = append(pc.Tokens, l.tokens...)
+
+	if m := runnerNameRx.FindStringSubmatch(name); m != nil {
+		if n, err := strconv.Atoi(m[2]); err == nil {
+			r := Runner{
+				Num: n,
+				TokenStart: len(pc.Tokens) - 1,
+				TokenEnd: len(pc.Tokens) - 1,
+				Dir: filepath.Join(config.RunnersDir, name),
+			}
+			runners := append(pc.Runners[m[1]], r)
+			sort.Slice(runners, func (i, j int) bool { return runners[i].Num < runners[j].Num })
+			pc.Runners[m[1]] = runners
+		}
+	}
+	return nil
+}
+
+// DeleteRunner removes the component of the runner num from the
+// configuration.
+func (pc *PiesConfig) DeleteRunner(key string, num int) error {
+	r := pc.Runners[key]
+	i := sort.Search(len(r), func(i int) bool { return r[i].Num >= num })
+	if !(i < len(r) && r[i].Num == num) {
+		return fmt.Errorf("%s: no runner %d", key, num)
+	}
+
+	start := r[i].TokenStart
+	end := r[i].TokenEnd + 1
+	if end < len(pc.Tokens) && pc.Tokens[end].Text == "\n" {
+		end += 1
+	}
+	pc.Tokens = append(pc.Tokens[:start], pc.Tokens[end:]...)
+
+	if len(r) == 1 {
+		delete(pc.Runners, key)
+	} else {
+		pc.Runners[key] = append(r[:i], r[i+1:]...)
+	}
+
+	// Adjust locations of the runners that follow the removed one
+	shift := end - start
+	for _, runners := range pc.Runners {
+		for j := range runners {
+			if runners[j].TokenStart > start {
+				runners[j].TokenStart -= shift
+				runners[j].TokenEnd -= shift
+			}
+		}
+	}
 	return nil
 }
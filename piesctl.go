@@ -16,6 +16,7 @@ import (
 	"encoding/json"
 	"regexp"
 	"syscall"
+	"strings"
 )
 
 // ----------------------------------
@@ -50,6 +51,10 @@ func PiesClient(controlURL *url.URL, method, path string, retval interface{}) (r
 	}
 
 	rurl := &url.URL{Scheme: "http", Path: path}
+	if n := strings.IndexByte(path, '?'); n != -1 {
+		rurl.Path = path[:n]
+		rurl.RawQuery = path[n+1:]
+	}
 	if controlURL.Scheme == "inet" {
 		rurl.Host = controlURL.Host
 	} else {
@@ -136,6 +141,7 @@ func GetPiesInstanceInfo(controlURL *url.URL) (err error, info PiesInstanceInfo)
 }
 
 type PiesComponentInfo struct {
+	Tag string          `json:"tag"`
 	Mode string         `json:"mode"`
 	Status string       `json:"status"`
 	PID int             `json:"PID"`
@@ -153,3 +159,79 @@ func GetPiesComponentInfo(controlURL *url.URL) (err error, info []PiesComponentI
 	return
 }
 
+
+// Returns the query path selecting the component with the given name.
+func piesComponentPath(name string) string {
+	match, _ := json.Marshal(map[string]string{"op": "component", "arg": name})
+	return `/programs?match=` + url.QueryEscape(string(match))
+}
+
+// Sends a request to the component with the given name.  Pies replies
+// with an array of per-component statuses.
+func piesComponentRequest(controlURL *url.URL, method, name string) error {
+	var resp []PiesResponse
+	if err := PiesClient(controlURL, method, piesComponentPath(name), &resp); err != nil {
+		return err
+	}
+	if len(resp) == 0 {
+		return fmt.Errorf("%s: no such component", name)
+	}
+	for _, r := range resp {
+		if r.Status != "OK" {
+			return errors.New(r.Message)
+		}
+	}
+	return nil
+}
+
+func PiesStopComponent(controlURL *url.URL, name string) error {
+	return piesComponentRequest(controlURL, http.MethodDelete, name)
+}
+
+func PiesStartComponent(controlURL *url.URL, name string) error {
+	return piesComponentRequest(controlURL, http.MethodPut, name)
+}
+
+// GetPiesComponentStatus returns the status of the component with the
+// given name.
+func GetPiesComponentStatus(controlURL *url.URL, name string) (string, error) {
+	var info []PiesComponentInfo
+	if err := PiesClient(controlURL, http.MethodGet, piesComponentPath(name), &info); err != nil {
+		return "", err
+	}
+	if len(info) == 0 {
+		return "", fmt.Errorf("%s: no such component", name)
+	}
+	return info[0].Status, nil
+}
+
+// ErrRunnerBusy is returned by RestartIdleRunner if the runner is running
+// a job.
+var ErrRunnerBusy = errors.New("runner is busy")
+
+// RestartIdleRunner restarts the component of the runner projectName of
+// the entity, if it is running.  A runner that GitHub reports as running
+// a job is not restarted, since that would abort the job: ErrRunnerBusy
+// is returned instead.
+func RestartIdleRunner(ent entityValue, controlURL *url.URL, projectName string) error {
+	status, err := GetPiesComponentStatus(controlURL, projectName)
+	if err != nil {
+		return err
+	}
+	if status != `running` {
+		return nil
+	}
+	pat, err := GetToken(ent.PATKey())
+	if err != nil {
+		return fmt.Errorf("can't determine whether the runner is busy: %v", err)
+	}
+	if busy, err := RunnerIsBusy(ent, pat, projectName); err != nil {
+		return err
+	} else if busy {
+		return ErrRunnerBusy
+	}
+	if err := PiesStopComponent(controlURL, projectName); err != nil {
+		return err
+	}
+	return PiesStartComponent(controlURL, projectName)
+}
@@ -0,0 +1,274 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"regexp"
+	"strings"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Runner environment (.env) files
+// ----------------------------------
+
+const (
+	EnvJobStartedHook = `ACTIONS_RUNNER_HOOK_JOB_STARTED`
+	EnvJobCompletedHook = `ACTIONS_RUNNER_HOOK_JOB_COMPLETED`
+)
+
+// EnvFile keeps the contents of a runner .env file: one VAR=VALUE
+// assignment per line.  Lines that are not assignments are preserved
+// as is.
+type EnvFile struct {
+	FileName string
+	Lines []string
+}
+
+// ReadEnvFile reads the environment file.  A missing file is treated
+// as empty.
+func ReadEnvFile(filename string) (*EnvFile, error) {
+	env := &EnvFile{FileName: filename}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return env, nil
+		}
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" {
+			env.Lines = append(env.Lines, line)
+		}
+	}
+	return env, nil
+}
+
+// Returns the index of the line assigning to name, or -1.
+func (env *EnvFile) find(name string) int {
+	for i, line := range env.Lines {
+		if strings.HasPrefix(line, name + `=`) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (env *EnvFile) Get(name string) (string, bool) {
+	if i := env.find(name); i != -1 {
+		return env.Lines[i][len(name)+1:], true
+	}
+	return "", false
+}
+
+func (env *EnvFile) Set(name, value string) {
+	line := name + `=` + value
+	if i := env.find(name); i != -1 {
+		env.Lines[i] = line
+	} else {
+		env.Lines = append(env.Lines, line)
+	}
+}
+
+func (env *EnvFile) Unset(name string) {
+	if i := env.find(name); i != -1 {
+		env.Lines = append(env.Lines[:i], env.Lines[i+1:]...)
+	}
+}
+
+// Save writes the file atomically.  The file is readable by its owner
+// only, since it can contain credentials (e.g. the proxy password).
+func (env *EnvFile) Save() error {
+	var content []byte
+	for _, line := range env.Lines {
+		content = append(content, line...)
+		content = append(content, '\n')
+	}
+	return writeFileAtomic(env.FileName, content, 0600)
+}
+
+// Writes content to a temporary file in the same directory and renames it
+// to filename.
+func writeFileAtomic(filename string, content []byte, mode os.FileMode) error {
+	tempfile, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename) + `.*`)
+	if err != nil {
+		return fmt.Errorf("can't create temporary file: %v", err)
+	}
+	tempname := tempfile.Name()
+	defer os.Remove(tempname)
+	if _, err := tempfile.Write(content); err != nil {
+		tempfile.Close()
+		return err
+	}
+	if err := tempfile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tempname, mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tempname, filename); err != nil {
+		return fmt.Errorf("can't rename %s to %s: %v", tempname, filename, err)
+	}
+	return nil
+}
+
+// Sets or removes the variable, depending on whether value is empty.
+func (env *EnvFile) setOrUnset(name, value string) {
+	if value == "" {
+		env.Unset(name)
+	} else {
+		env.Set(name, value)
+	}
+}
+
+// EntityHooks returns the job hooks configured for the entity.
+// Per-entity settings override global ones.
+func EntityHooks(ent entityValue) (started, completed string) {
+	started = config.JobStartedHook
+	completed = config.JobCompletedHook
+	if ec := config.EntityConfig(ent); ec != nil {
+		if ec.JobStartedHook != "" {
+			started = ec.JobStartedHook
+		}
+		if ec.JobCompletedHook != "" {
+			completed = ec.JobCompletedHook
+		}
+	}
+	return
+}
+
+// ApplyHooks stores the job hooks configured for the entity in the
+// environment of the runner.
+func ApplyHooks(ent entityValue, env *EnvFile) {
+	started, completed := EntityHooks(ent)
+	env.setOrUnset(EnvJobStartedHook, started)
+	env.setOrUnset(EnvJobCompletedHook, completed)
+}
+
+// RunnerEnv represents the environment of a runner.  The runner takes
+// PATH from the .path file and the rest of variables from .env.
+type RunnerEnv struct {
+	Env *EnvFile
+	PathFile string
+	Path string
+	HasPath bool
+	pathModified bool
+}
+
+func ReadRunnerEnv(dirname string) (*RunnerEnv, error) {
+	env, err := ReadEnvFile(filepath.Join(dirname, `.env`))
+	if err != nil {
+		return nil, err
+	}
+	re := &RunnerEnv{Env: env, PathFile: filepath.Join(dirname, `.path`)}
+	content, err := ioutil.ReadFile(re.PathFile)
+	if err == nil {
+		re.Path = strings.TrimRight(string(content), "\n")
+		re.HasPath = true
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return re, nil
+}
+
+func (re *RunnerEnv) Get(name string) (string, bool) {
+	if name == `PATH` {
+		return re.Path, re.HasPath
+	}
+	return re.Env.Get(name)
+}
+
+func (re *RunnerEnv) Set(name, value string) {
+	if name == `PATH` {
+		re.Path = value
+		re.HasPath = true
+		re.pathModified = true
+	} else {
+		re.Env.Set(name, value)
+	}
+}
+
+func (re *RunnerEnv) Unset(name string) {
+	if name == `PATH` {
+		re.Path = ""
+		re.HasPath = false
+		re.pathModified = true
+	} else {
+		re.Env.Unset(name)
+	}
+}
+
+// List returns all variables as VAR=VALUE strings.
+func (re *RunnerEnv) List() []string {
+	list := append([]string{}, re.Env.Lines...)
+	if re.HasPath {
+		list = append(list, `PATH=` + re.Path)
+	}
+	return list
+}
+
+func (re *RunnerEnv) Save() error {
+	if err := re.Env.Save(); err != nil {
+		return err
+	}
+	if re.pathModified {
+		if re.HasPath {
+			if err := writeFileAtomic(re.PathFile, []byte(re.Path + "\n"), 0640); err != nil {
+				return err
+			}
+		} else if err := os.Remove(re.PathFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		re.pathModified = false
+	}
+	return nil
+}
+
+var envNameRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// CheckEnvVariable verifies that the variable can be stored in the
+// runner environment.
+func CheckEnvVariable(name, value string) error {
+	if !envNameRx.MatchString(name) {
+		return fmt.Errorf("%q: invalid variable name", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("%s: value can't contain newlines", name)
+	}
+	return nil
+}
+
+// SetupRunnerEnv updates the environment of the runner projectName with
+// the settings from the ghb configuration.
+func SetupRunnerEnv(projectName string) error {
+	ent, _, err := ParseRunnerName(projectName)
+	if err != nil {
+		return err
+	}
+	re, err := ReadRunnerEnv(filepath.Join(config.RunnersDir, projectName))
+	if err != nil {
+		return err
+	}
+	for _, v := range RunnerHTTPEnv() {
+		re.Set(v[0], v[1])
+	}
+	if ec := config.EntityConfig(ent); ec != nil {
+		var names []string
+		for name := range ec.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			re.Set(name, ec.Env[name])
+		}
+	}
+	ApplyHooks(ent, re.Env)
+	return re.Save()
+}
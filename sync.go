@@ -0,0 +1,393 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"io/fs"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Reconciliation of local runners with GitHub
+// ----------------------------------
+
+// Kinds of mismatches
+const (
+	// Component in pies.conf, but no runner directory
+	SyncDeadComponent = iota
+	// Runner directory, but no component in pies.conf
+	SyncOrphanDirectory
+	// Runner registered at GitHub, but not present locally
+	SyncOrphanRegistration
+	// Local runner not registered at GitHub
+	SyncUnregistered
+)
+
+var syncKindName = []string{
+	`dead component`,
+	`orphan directory`,
+	`orphan registration`,
+	`unregistered`,
+}
+
+type SyncMismatch struct {
+	Kind int
+	Name string      // Runner name (directory relative to RunnersDir)
+	Dir string       // Runner directory
+	GHRunner *GHRunner // GitHub runner, if registered
+}
+
+func (m SyncMismatch) String() string {
+	s := fmt.Sprintf("%-20s ", syncKindName[m.Kind])
+	if m.Name != "" {
+		s += m.Name
+	} else {
+		s += "-"
+	}
+	if m.GHRunner != nil {
+		s += fmt.Sprintf(" (%s, ID %d, %s)", m.GHRunner.Name, m.GHRunner.ID, m.GHRunner.Status)
+	}
+	return s
+}
+
+// ScanRunnerDirs returns a map of runner directories found under
+// RunnersDir, indexed by the entity key.  Each value maps the runner
+// ordinal number to the directory name.
+func ScanRunnerDirs() (map[string]map[int]string, error) {
+	result := make(map[string]map[int]string)
+	for _, pfx := range GHEntityPrefix {
+		root := filepath.Join(config.RunnersDir, pfx)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == root {
+					return filepath.SkipDir
+				}
+				return err
+			}
+			if !d.IsDir() || path == root {
+				return nil
+			}
+			num, err := strconv.Atoi(d.Name())
+			if err != nil {
+				return nil
+			}
+			if _, err := os.Stat(filepath.Join(path, `config.sh`)); err != nil {
+				return nil
+			}
+			rel, err := filepath.Rel(config.RunnersDir, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			key := `/` + filepath.ToSlash(rel)
+			if result[key] == nil {
+				result[key] = make(map[int]string)
+			}
+			result[key][num] = path
+			return filepath.SkipDir
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// SyncEntity cross-references the runners of the entity configured in
+// pies.conf, their directories and the runners registered at GitHub.
+// Returns the list of mismatches.
+func SyncEntity(ent entityValue, pc *PiesConfig, dirs map[int]string) ([]SyncMismatch, error) {
+	var result []SyncMismatch
+	key := ent.BaseKey()
+
+	// Local runners: components and directories
+	local := make(map[int]bool)
+	for _, r := range pc.Runners[key] {
+		local[r.Num] = true
+		if _, err := os.Stat(r.Dir); err != nil {
+			result = append(result, SyncMismatch{
+				Kind: SyncDeadComponent,
+				Name: filepath.Join(key, strconv.Itoa(r.Num)),
+				Dir: r.Dir,
+			})
+		}
+	}
+	for num, dir := range dirs {
+		if !local[num] {
+			result = append(result, SyncMismatch{
+				Kind: SyncOrphanDirectory,
+				Name: filepath.Join(key, strconv.Itoa(num)),
+				Dir: dir,
+			})
+		}
+	}
+
+	// GitHub registrations
+	pat, err := GetToken(ent.PATKey())
+	if err != nil {
+		return result, err
+	}
+	ghRunners, err := GitHubListRunners(ent, pat)
+	if err != nil {
+		return result, err
+	}
+	registered := make(map[string]*GHRunner)
+	for i := range ghRunners {
+		registered[ghRunners[i].Name] = &ghRunners[i]
+	}
+
+	for i := range result {
+		name, _ := RegisteredRunnerName(result[i].Dir, result[i].Name)
+		if gr, ok := registered[name]; ok {
+			result[i].GHRunner = gr
+			delete(registered, name)
+		}
+	}
+
+	for _, r := range pc.Runners[key] {
+		if _, ok := dirs[r.Num]; !ok {
+			continue
+		}
+		name := filepath.Join(key, strconv.Itoa(r.Num))
+		regName, err := RegisteredRunnerName(r.Dir, name)
+		if err != nil {
+			return result, err
+		}
+		if _, ok := registered[regName]; ok {
+			delete(registered, regName)
+		} else if !IsEphemeralRunner(r.Dir) {
+			// Ephemeral runners are unregistered between jobs
+			result = append(result, SyncMismatch{
+				Kind: SyncUnregistered,
+				Name: name,
+				Dir: r.Dir,
+			})
+		}
+	}
+
+	// Remaining registered runners with names matching the naming
+	// template for this host are orphans
+	rx, err := RunnerNameRegexp(ent)
+	if err != nil {
+		return result, err
+	}
+	for name, gr := range registered {
+		if rx.MatchString(name) {
+			result = append(result, SyncMismatch{
+				Kind: SyncOrphanRegistration,
+				GHRunner: gr,
+			})
+		}
+	}
+
+	sort.SliceStable(result, func (i, j int) bool {
+		if result[i].Kind != result[j].Kind {
+			return result[i].Kind < result[j].Kind
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// ReregisterRunner registers anew the runner from the directory dirname,
+// whose registration has been removed from GitHub.  The runner keeps the
+// labels and runner group it was added with, and its environment is set
+// up again, as done by the add action.
+func ReregisterRunner(ent entityValue, name, dirname string) error {
+	runnerName, err := RegisteredRunnerName(dirname, name)
+	if err != nil {
+		return err
+	}
+	ro, err := ReadRunnerOptions(dirname)
+	if err != nil {
+		return err
+	}
+	projectUrl := ent.ProjectURL("")
+	if rs, err := ReadRunnerSettings(dirname); err == nil && rs.GitHubURL != "" {
+		projectUrl = rs.GitHubURL
+	}
+
+	token, err := GetToken(ent.TokenKey(RegistrationToken))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{`.runner`, `.credentials`, `.credentials_rsaparams`} {
+		if err := os.Remove(filepath.Join(dirname, f)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := ConfigureRunner(dirname, runnerName, projectUrl, token, ro.ConfigOpts(), os.Stdout); err != nil {
+		return err
+	}
+	return SetupRunnerEnv(name)
+}
+
+// Deletes the registration of the runner gr, if any.
+func deleteRegistration(ent entityValue, gr *GHRunner) error {
+	if gr == nil {
+		return nil
+	}
+	pat, err := GetToken(ent.PATKey())
+	if err != nil {
+		return err
+	}
+	return GitHubDeleteRunner(ent, pat, gr.ID)
+}
+
+// FixMismatch attempts to fix the mismatch.  Returns true if pc has been
+// modified.
+func FixMismatch(ent entityValue, pc *PiesConfig, m SyncMismatch) (bool, error) {
+	switch m.Kind {
+	case SyncDeadComponent:
+		if err := deleteRegistration(ent, m.GHRunner); err != nil {
+			return false, err
+		}
+		_, num, err := ParseRunnerName(m.Name)
+		if err != nil {
+			return false, err
+		}
+		return true, pc.DeleteRunner(ent.BaseKey(), num)
+
+	case SyncOrphanDirectory:
+		if err := deleteRegistration(ent, m.GHRunner); err != nil {
+			return false, err
+		}
+		if err := os.RemoveAll(m.Dir); err != nil {
+			return false, fmt.Errorf("failed to remove %s: %v", m.Dir, err)
+		}
+
+	case SyncOrphanRegistration:
+		return false, deleteRegistration(ent, m.GHRunner)
+
+	case SyncUnregistered:
+		// Stop the component, so that run.sh doesn't use the runner
+		// directory while it is being reconfigured.
+		status, err := GetPiesComponentStatus(pc.ControlURL, m.Name)
+		if err != nil {
+			return false, err
+		}
+		if status == `running` {
+			if err := PiesStopComponent(pc.ControlURL, m.Name); err != nil {
+				return false, fmt.Errorf("can't stop: %v", err)
+			}
+		}
+		if err := ReregisterRunner(ent, m.Name, m.Dir); err != nil {
+			if status == `running` {
+				err = fmt.Errorf("%v; component left stopped", err)
+			}
+			return false, err
+		}
+		if err := PiesStartComponent(pc.ControlURL, m.Name); err != nil {
+			return false, fmt.Errorf("can't start: %v", err)
+		}
+	}
+	return false, nil
+}
+
+func SyncAction(args []string) {
+	ReadConfig()
+	FinalizeConfig()
+	optset := NewEntityOptset(args)
+	optset.SetParameters("")
+	fix := false
+	optset.FlagLong(&fix, "fix", 0, "Fix the mismatches")
+	// Entity is optional: don't call optset.Parse
+	optset.Optset.Parse()
+
+	if len(optset.Args()) != 0 {
+		log.Fatalf("too many arguments; try `%s --help' for assistance", optset.Command)
+	}
+
+	if fix {
+		lock, err := LockRoot()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer lock.Unlock()
+	}
+
+	pc, err := ParsePiesConfig(config.PiesConfigFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	dirs, err := ScanRunnerDirs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var keys []string
+	if optset.Entity.Name != "" {
+		keys = append(keys, optset.Entity.BaseKey())
+	} else {
+		seen := make(map[string]bool)
+		for key := range pc.Runners {
+			seen[key] = true
+		}
+		for key := range dirs {
+			seen[key] = true
+		}
+		for key := range seen {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	status := 0
+	modified := false
+	for _, key := range keys {
+		ent, err := ParseEntityKey(key)
+		if err != nil {
+			log.Print(err)
+			status = 1
+			continue
+		}
+		mismatches, err := SyncEntity(ent, pc, dirs[key])
+		if err != nil {
+			log.Printf("%s: %v", key, err)
+			status = 1
+		}
+		if len(mismatches) == 0 {
+			if err == nil {
+				fmt.Printf("%s: OK\n", key)
+			}
+			continue
+		}
+		fmt.Printf("%s:\n", key)
+		for _, m := range mismatches {
+			fmt.Printf("  %s\n", m)
+		}
+		if !fix {
+			status = 1
+			continue
+		}
+		for _, m := range mismatches {
+			changed, err := FixMismatch(ent, pc, m)
+			if err != nil {
+				log.Printf("%s: can't fix: %v", m, err)
+				status = 1
+			}
+			if changed {
+				modified = true
+			}
+		}
+	}
+
+	if modified {
+		if err := pc.Save(); err != nil {
+			log.Fatal(err)
+		}
+		if err := PiesReloadConfig(pc.ControlURL); err != nil {
+			log.Fatalf("Pies configuration updated, but pies not reloaded: %v", err)
+		}
+	}
+	os.Exit(status)
+}
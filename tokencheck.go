@@ -0,0 +1,133 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"time"
+	"sort"
+	"errors"
+)
+
+// ----------------------------------
+// Token expiry monitoring
+// ----------------------------------
+
+const (
+	TokenOK = `ok`
+	TokenExpiring = `expiring`
+	TokenExpired = `expired`
+	// Registration, remove and installation tokens are obtained
+	// automatically when needed, so their expiration is not a problem.
+	TokenCached = `cached`
+)
+
+type TokenStatus struct {
+	Key string
+	ExpiresAt time.Time
+	IsPAT bool
+	State string
+}
+
+// Remaining returns the remaining lifetime of the token.
+func (ts TokenStatus) Remaining() time.Duration {
+	return time.Until(ts.ExpiresAt)
+}
+
+// Problem returns true if the token needs attention.
+func (ts TokenStatus) Problem() bool {
+	return ts.State == TokenExpiring || ts.State == TokenExpired
+}
+
+// CheckTokens returns the status of all tokens in the token database,
+// sorted by key.  PATs expiring within window are marked as expiring.
+func CheckTokens(window time.Duration) ([]TokenStatus, error) {
+	next, err := PrefixIterator("")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []TokenStatus
+	now := time.Now()
+	for {
+		key, tok, err := next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		ts := TokenStatus{Key: key, ExpiresAt: tok.ExpiresAt}
+		_, ts.IsPAT = GetBaseKey(key)
+		switch {
+		case !ts.IsPAT:
+			ts.State = TokenCached
+		case !now.Before(tok.ExpiresAt):
+			ts.State = TokenExpired
+		case now.Add(window).After(tok.ExpiresAt):
+			ts.State = TokenExpiring
+		default:
+			ts.State = TokenOK
+		}
+		result = append(result, ts)
+	}
+	sort.Slice(result, func (i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+// Formats the remaining lifetime of the token.
+func formatRemaining(ts TokenStatus) string {
+	if ts.ExpiresAt.Equal(NoExpiration) {
+		return `never`
+	}
+	d := ts.Remaining()
+	if d <= 0 {
+		return `-`
+	}
+	if d >= 24 * time.Hour {
+		return fmt.Sprintf("%dd%dh", int(d / (24 * time.Hour)), int(d % (24 * time.Hour) / time.Hour))
+	}
+	return d.Truncate(time.Minute).String()
+}
+
+// PrintTokenStatus lists the tokens.  Returns the number of tokens needing
+// attention.
+func PrintTokenStatus(list []TokenStatus) (problems int) {
+	fmt.Printf("%-56.56s %-8s %-20s %s\n", "KEY", "STATE", "EXPIRES", "REMAINING")
+	for _, ts := range list {
+		expires := `never`
+		if !ts.ExpiresAt.Equal(NoExpiration) {
+			expires = ts.ExpiresAt.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%-56.56s %-8s %-20s %s\n", ts.Key, ts.State, expires, formatRemaining(ts))
+		if ts.Problem() {
+			problems++
+		}
+	}
+	return
+}
+
+// TokenSummary returns a one-line summary of the PAT status.
+func TokenSummary(list []TokenStatus, window time.Duration) string {
+	var pats, expiring, expired int
+	for _, ts := range list {
+		if !ts.IsPAT {
+			continue
+		}
+		pats++
+		switch ts.State {
+		case TokenExpiring:
+			expiring++
+		case TokenExpired:
+			expired++
+		}
+	}
+	return fmt.Sprintf("%d PATs, %d expiring within %s, %d expired", pats, expiring, window, expired)
+}
@@ -0,0 +1,346 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+)
+
+// ----------------------------------
+// Token database encryption
+// ----------------------------------
+
+// If a passphrase or key file is configured, token database values are
+// encrypted with AES-256-GCM.  The key is derived from the secret using
+// PBKDF2-HMAC-SHA256 with the salt kept in the special database record
+// tokenCryptMetaKey.  Encrypted values are prefixed with tokenCryptMagic,
+// which allows plaintext values to coexist with encrypted ones while the
+// database is being migrated.
+
+const (
+	tokenCryptMetaKey = `.ghb-token-encryption`
+	tokenCryptMagic = "ghb-aes256gcm\x00"
+	tokenCryptIterations = 100000
+	tokenCryptCheck = `ghb token database`
+
+	// Environment variable overriding the token_passphrase setting.
+	EnvTokenPassphrase = `GHB_TOKEN_PASSPHRASE`
+	// Environment variable with the old passphrase (for rekeying).
+	EnvTokenOldPassphrase = `GHB_TOKEN_OLD_PASSPHRASE`
+)
+
+var (
+	ErrTokenDBEncrypted = errors.New("token database is encrypted, but no passphrase or key file is configured")
+	ErrTokenDBBadSecret = errors.New("wrong passphrase or key file for the token database")
+)
+
+type tokenCryptMeta struct {
+	Salt []byte      `json:"salt"`
+	Iterations int   `json:"iterations"`
+	Check []byte     `json:"check"`
+}
+
+// ReadTokenSecret reads the secret from the key file, if filename is not
+// empty.  Otherwise, returns the passphrase from the environment or the
+// configuration.  Returns nil if no secret is configured.
+func ReadTokenSecret(filename string) ([]byte, error) {
+	if filename != "" {
+		return readSecretFile(filename)
+	}
+	if s := os.Getenv(EnvTokenPassphrase); s != "" {
+		return []byte(s), nil
+	}
+	if config.TokenPassphrase != "" {
+		return []byte(config.TokenPassphrase), nil
+	}
+	return nil, nil
+}
+
+// Reads the secret from the file.  Trailing newlines are removed.
+func readSecretFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("can't read key file: %v", err)
+	}
+	b = bytes.TrimRight(b, "\r\n")
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%s: key file is empty", filename)
+	}
+	return b, nil
+}
+
+// TokenSecret returns the configured token database secret, or nil.
+func TokenSecret() ([]byte, error) {
+	return ReadTokenSecret(config.TokenKeyFile)
+}
+
+// OldTokenSecret returns the secret the token database is currently
+// encrypted with, when it is being rekeyed.  It is read from keyFile or
+// passphraseFile, if given, or from the environment variable
+// GHB_TOKEN_OLD_PASSPHRASE.  If none of these is supplied, the currently
+// configured secret is returned.
+func OldTokenSecret(keyFile, passphraseFile string) ([]byte, error) {
+	switch {
+	case keyFile != "" && passphraseFile != "":
+		return nil, errors.New("old key file and old passphrase file are mutually exclusive")
+	case keyFile != "":
+		return readSecretFile(keyFile)
+	case passphraseFile != "":
+		return readSecretFile(passphraseFile)
+	}
+	if s := os.Getenv(EnvTokenOldPassphrase); s != "" {
+		return []byte(s), nil
+	}
+	return TokenSecret()
+}
+
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var dk []byte
+	for block := uint32(1); len(dk) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		dk = append(dk, t...)
+	}
+	return dk[:keyLen]
+}
+
+// tokenCodec encodes and decodes token database values.  A codec with
+// nil aead keeps values in plaintext.
+type tokenCodec struct {
+	aead cipher.AEAD
+}
+
+func tokenCheckValue(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(tokenCryptCheck))
+	return mac.Sum(nil)
+}
+
+func newTokenCodec(secret []byte, meta tokenCryptMeta) (*tokenCodec, error) {
+	key := pbkdf2SHA256(secret, meta.Salt, meta.Iterations, 32)
+	if !hmac.Equal(tokenCheckValue(key), meta.Check) {
+		return nil, ErrTokenDBBadSecret
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenCodec{aead: aead}, nil
+}
+
+// Creates new encryption parameters for the secret.
+func newTokenCryptMeta(secret []byte) (meta tokenCryptMeta, err error) {
+	meta.Salt = make([]byte, 16)
+	if _, err = rand.Read(meta.Salt); err != nil {
+		return
+	}
+	meta.Iterations = tokenCryptIterations
+	meta.Check = tokenCheckValue(pbkdf2SHA256(secret, meta.Salt, meta.Iterations, 32))
+	return
+}
+
+// Returns the codec for the database kv, using the given secret.
+func tokenCodecFor(kv kvStore, secret []byte) (*tokenCodec, error) {
+	js, err := kv.Get(tokenCryptMetaKey)
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			return &tokenCodec{}, nil
+		}
+		return nil, err
+	}
+	if secret == nil {
+		return nil, ErrTokenDBEncrypted
+	}
+	var meta tokenCryptMeta
+	if err := json.Unmarshal(js, &meta); err != nil {
+		return nil, fmt.Errorf("malformed token encryption record: %v", err)
+	}
+	return newTokenCodec(secret, meta)
+}
+
+func (c *tokenCodec) Encode(key string, value []byte) ([]byte, error) {
+	if c.aead == nil {
+		return value, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize(), len(tokenCryptMagic) + c.aead.NonceSize() + len(value) + c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := c.aead.Seal(nonce, nonce, value, []byte(key))
+	return append([]byte(tokenCryptMagic), sealed...), nil
+}
+
+// Decode returns the plaintext value.  Values that are not encrypted are
+// returned as is.
+func (c *tokenCodec) Decode(key string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, []byte(tokenCryptMagic)) {
+		return value, nil
+	}
+	if c.aead == nil {
+		return nil, ErrTokenDBEncrypted
+	}
+	value = value[len(tokenCryptMagic):]
+	n := c.aead.NonceSize()
+	if len(value) < n {
+		return nil, fmt.Errorf("%s: malformed encrypted value", key)
+	}
+	plain, err := c.aead.Open(nil, value[:n], value[n:], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't decrypt: %v", key, err)
+	}
+	return plain, nil
+}
+
+// Encrypts plaintext database in place.
+func encryptTokenDB(kv kvStore, secret []byte) (*tokenCodec, error) {
+	meta, err := newTokenCryptMeta(secret)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := newTokenCodec(secret, meta)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := kvTokenKeys(kv)
+	if err != nil {
+		return nil, err
+	}
+	js, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	if err := kv.Put(tokenCryptMetaKey, js); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		value, err := kv.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(value, []byte(tokenCryptMagic)) {
+			continue
+		}
+		if value, err = codec.Encode(key, value); err != nil {
+			return nil, err
+		}
+		if err := kv.Put(key, value); err != nil {
+			return nil, err
+		}
+	}
+	return codec, nil
+}
+
+// RekeyTokenDB re-encrypts the token database.  Values are decrypted using
+// oldSecret and encrypted with the currently configured secret.  If no
+// secret is configured, the database is decrypted.  The new database
+// replaces the old one only when all values have been converted.
+func RekeyTokenDB(oldSecret []byte) error {
+	store, err := GetTokenStore()
+	if err != nil {
+		return err
+	}
+	kvs, ok := store.(*kvTokenStore)
+	if !ok {
+		return errors.New("configured token store doesn't support encryption")
+	}
+
+	// Hold the write lock until the new database replaces the old one
+	lock, err := kvs.lock(true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	kv, err := kvs.backend.Open(false)
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	oldCodec, err := tokenCodecFor(kv, oldSecret)
+	if err != nil {
+		return err
+	}
+	keys, err := kvTokenKeys(kv)
+	if err != nil {
+		return err
+	}
+
+	newSecret, err := TokenSecret()
+	if err != nil {
+		return err
+	}
+
+	newkv, err := kvs.backend.Create()
+	if err != nil {
+		return err
+	}
+
+	newCodec := &tokenCodec{}
+	if newSecret != nil {
+		meta, err := newTokenCryptMeta(newSecret)
+		if err != nil {
+			newkv.Abort()
+			return err
+		}
+		if newCodec, err = newTokenCodec(newSecret, meta); err != nil {
+			newkv.Abort()
+			return err
+		}
+		js, err := json.Marshal(meta)
+		if err != nil {
+			newkv.Abort()
+			return err
+		}
+		if err := newkv.Put(tokenCryptMetaKey, js); err != nil {
+			newkv.Abort()
+			return err
+		}
+	}
+
+	for _, key := range keys {
+		value, err := kv.Get(key)
+		if err == nil {
+			value, err = oldCodec.Decode(key, value)
+		}
+		if err == nil {
+			value, err = newCodec.Encode(key, value)
+		}
+		if err == nil {
+			err = newkv.Put(key, value)
+		}
+		if err != nil {
+			newkv.Abort()
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return newkv.Close()
+}
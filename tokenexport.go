@@ -0,0 +1,216 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"time"
+	"errors"
+	"strings"
+	"io/ioutil"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+)
+
+// ----------------------------------
+// Token database export and import
+// ----------------------------------
+
+const (
+	tokenExportVersion = 1
+	tokenExportKDF = `pbkdf2-sha256`
+	tokenExportCipher = `aes-256-gcm`
+
+	// Environment variable supplying the export passphrase.
+	EnvExportPassphrase = `GHB_EXPORT_PASSPHRASE`
+)
+
+type ExportedToken struct {
+	Key string           `json:"key"`
+	Token string         `json:"token"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+type tokenExportEncryption struct {
+	KDF string         `json:"kdf"`
+	Iterations int     `json:"iterations"`
+	Salt []byte        `json:"salt"`
+	Cipher string      `json:"cipher"`
+	Nonce []byte       `json:"nonce"`
+}
+
+// Export file format.  If Encryption is set, Data keeps the encrypted
+// JSON representation of Tokens.
+type tokenExport struct {
+	Version int                        `json:"version"`
+	Created time.Time                  `json:"created"`
+	Tokens []ExportedToken             `json:"tokens,omitempty"`
+	Encryption *tokenExportEncryption  `json:"encryption,omitempty"`
+	Data []byte                        `json:"data,omitempty"`
+}
+
+// Options for selecting tokens to export or import.
+type TokenFilter struct {
+	Prefix string
+	SkipExpired bool
+	SkipCached bool
+}
+
+// Match returns true if the token passes the filter.  The prefix matches
+// whole key components: "/orgs/foo" matches "/orgs/foo" and
+// "/orgs/foo/actions/runners/remove-token", but not "/orgs/foobar".
+func (f TokenFilter) Match(key string, expiresAt time.Time) bool {
+	if f.Prefix != "" && key != f.Prefix &&
+	   !strings.HasPrefix(key, strings.TrimSuffix(f.Prefix, `/`) + `/`) {
+		return false
+	}
+	if f.SkipExpired && !time.Now().Before(expiresAt) {
+		return false
+	}
+	if f.SkipCached {
+		if _, ispat := GetBaseKey(key); !ispat {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportPassphrase returns the passphrase for export file encryption,
+// read from filename or, if it is empty, from the environment.  Returns nil
+// if no passphrase is supplied.
+func ExportPassphrase(filename string) ([]byte, error) {
+	if filename != "" {
+		return readSecretFile(filename)
+	}
+	if s := os.Getenv(EnvExportPassphrase); s != "" {
+		return []byte(s), nil
+	}
+	return nil, nil
+}
+
+func exportAEAD(passphrase []byte, enc *tokenExportEncryption) (cipher.AEAD, error) {
+	if enc.KDF != tokenExportKDF || enc.Cipher != tokenExportCipher {
+		return nil, fmt.Errorf("unsupported encryption: %s, %s", enc.KDF, enc.Cipher)
+	}
+	block, err := aes.NewCipher(pbkdf2SHA256(passphrase, enc.Salt, enc.Iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// ExportTokens writes the tokens matching the filter to w.  If passphrase
+// is not nil, the tokens are encrypted.  Returns the number of exported
+// tokens.
+func ExportTokens(w io.Writer, filter TokenFilter, passphrase []byte) (int, error) {
+	next, err := PrefixIterator("")
+	if err != nil {
+		return 0, err
+	}
+	exp := tokenExport{Version: tokenExportVersion, Created: time.Now().UTC()}
+	for {
+		key, tok, err := next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		if filter.Match(key, tok.ExpiresAt) {
+			exp.Tokens = append(exp.Tokens, ExportedToken{Key: key, Token: tok.Token, ExpiresAt: tok.ExpiresAt})
+		}
+	}
+	count := len(exp.Tokens)
+
+	if passphrase != nil {
+		enc := &tokenExportEncryption{
+			KDF: tokenExportKDF,
+			Iterations: tokenCryptIterations,
+			Salt: make([]byte, 16),
+			Cipher: tokenExportCipher,
+		}
+		if _, err := rand.Read(enc.Salt); err != nil {
+			return 0, err
+		}
+		aead, err := exportAEAD(passphrase, enc)
+		if err != nil {
+			return 0, err
+		}
+		enc.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(enc.Nonce); err != nil {
+			return 0, err
+		}
+		js, err := json.Marshal(exp.Tokens)
+		if err != nil {
+			return 0, err
+		}
+		exp.Data = aead.Seal(nil, enc.Nonce, js, nil)
+		exp.Encryption = enc
+		exp.Tokens = nil
+	}
+
+	js, err := json.MarshalIndent(exp, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(append(js, '\n')); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ImportTokens reads the export file from r and stores the tokens matching
+// the filter in the token database.  Returns the number of imported tokens.
+func ImportTokens(r io.Reader, filter TokenFilter, passphrase []byte) (int, error) {
+	js, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	var exp tokenExport
+	if err := json.Unmarshal(js, &exp); err != nil {
+		return 0, fmt.Errorf("malformed export file: %v", err)
+	}
+	if exp.Version != tokenExportVersion {
+		return 0, fmt.Errorf("unsupported export file version %d", exp.Version)
+	}
+	if exp.Encryption != nil {
+		if passphrase == nil {
+			return 0, errors.New("export file is encrypted, but no passphrase is supplied")
+		}
+		aead, err := exportAEAD(passphrase, exp.Encryption)
+		if err != nil {
+			return 0, err
+		}
+		plain, err := aead.Open(nil, exp.Encryption.Nonce, exp.Data, nil)
+		if err != nil {
+			return 0, errors.New("can't decrypt export file: wrong passphrase?")
+		}
+		if err := json.Unmarshal(plain, &exp.Tokens); err != nil {
+			return 0, fmt.Errorf("malformed export file: %v", err)
+		}
+	}
+
+	count := 0
+	for _, t := range exp.Tokens {
+		if !filter.Match(t.Key, t.ExpiresAt) {
+			continue
+		}
+		if _, path := SplitKey(t.Key); path == "" {
+			return count, fmt.Errorf("malformed token key %q", t.Key)
+		} else if _, err := ParseEntityKey(path); err != nil {
+			return count, fmt.Errorf("malformed token key %q", t.Key)
+		}
+		if err := SaveToken(t.Key, GHToken{Token: t.Token, ExpiresAt: t.ExpiresAt}); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
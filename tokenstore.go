@@ -0,0 +1,336 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"time"
+	"sort"
+	"errors"
+	"strings"
+	"encoding/json"
+)
+
+// ----------------------------------
+// Token store
+// ----------------------------------
+
+// TokenStore keeps tokens indexed by their keys.
+type TokenStore interface {
+	// Fetch returns the token.  If there is no such token, returns
+	// ErrTokenNotFound.
+	Fetch(key string) (GHToken, error)
+	Store(key string, token GHToken) error
+	Delete(key string) error
+	// List returns the sorted list of keys starting with prefix.
+	List(prefix string) ([]string, error)
+}
+
+var (
+	ErrTokenStoreReadOnly = errors.New("token store is read-only")
+)
+
+// Registered token store backends, indexed by the name used in the
+// token_store configuration setting.
+var tokenStores = make(map[string]func() (TokenStore, error))
+
+func RegisterTokenStore(name string, open func() (TokenStore, error)) {
+	tokenStores[name] = open
+}
+
+// DefaultTokenStore returns the name of the token store used when
+// token_store is not set: gdbm, if it is compiled in, and file otherwise.
+func DefaultTokenStore() string {
+	if _, ok := tokenStores[`gdbm`]; ok {
+		return `gdbm`
+	}
+	return `file`
+}
+
+func TokenStoreNames() (names []string) {
+	for name := range tokenStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+var currentTokenStore TokenStore
+
+// GetTokenStore returns the token store selected in the configuration.
+func GetTokenStore() (TokenStore, error) {
+	if currentTokenStore == nil {
+		name := config.TokenStore
+		if name == "" {
+			name = DefaultTokenStore()
+		}
+		open, ok := tokenStores[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown token store %q", name)
+		}
+		store, err := open()
+		if err != nil {
+			return nil, err
+		}
+		currentTokenStore = store
+	}
+	return currentTokenStore, nil
+}
+
+func SaveToken(key string, token GHToken) error {
+	store, err := GetTokenStore()
+	if err != nil {
+		return err
+	}
+	return store.Store(key, token)
+}
+
+func FetchRawToken(key string) (GHToken, error) {
+	store, err := GetTokenStore()
+	if err != nil {
+		return GHToken{}, err
+	}
+	return store.Fetch(key)
+}
+
+func FetchToken(key string) (string, error) {
+	if tok, err := FetchRawToken(key); err == nil {
+		if time.Now().Before(tok.ExpiresAt) {
+			return tok.Token, nil
+		}
+		return "", ErrTokenNotFound
+	} else {
+		return "", err
+	}
+}
+
+func DeleteToken(key string) error {
+	store, err := GetTokenStore()
+	if err != nil {
+		return err
+	}
+	return store.Delete(key)
+}
+
+// PrefixIterator returns a function that on each call returns the next
+// token whose key starts with pfx (excluding pfx itself).  When there
+// are no more tokens, it returns io.EOF.  Use empty pfx to iterate over
+// all tokens, including those of other hosts (see SplitKey).
+func PrefixIterator(pfx string) (func () (string, GHToken, error), error) {
+	store, err := GetTokenStore()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := store.List(pfx)
+	if err != nil {
+		return nil, err
+	}
+	return func() (key string, tok GHToken, err error) {
+		for len(keys) > 0 {
+			key = keys[0]
+			keys = keys[1:]
+			if key == pfx {
+				continue
+			}
+			tok, err = store.Fetch(key)
+			return
+		}
+		err = io.EOF
+		return
+	}, nil
+}
+
+// ----------------------------------
+// Key-value token stores
+// ----------------------------------
+
+// kvStore is a raw key-value database keeping encoded tokens.
+type kvStore interface {
+	// Get returns ErrTokenNotFound if there's no such key.
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	Keys() ([]string, error)
+	// Close commits the changes and closes the database.
+	Close() error
+	// Abort closes the database, discarding the changes, if possible.
+	Abort()
+}
+
+type kvBackend interface {
+	// Open opens the database.  If it doesn't exist, it is created if
+	// write is true.  Otherwise, an error satisfying
+	// errors.Is(err, os.ErrNotExist) is returned.
+	Open(write bool) (kvStore, error)
+	// Create returns new empty database.  On Close, it replaces the
+	// existing one.
+	Create() (kvStore, error)
+}
+
+// kvTokenStore implements TokenStore on top of a key-value database.
+// Values are JSON representations of the tokens, optionally encrypted
+// (see tokencrypt.go).
+type kvTokenStore struct {
+	backend kvBackend
+	// Lock file serializing access to the database: writers hold
+	// exclusive lock on it, readers hold shared lock.
+	lockfile string
+}
+
+// lockedKV releases the lock when the database is closed.
+type lockedKV struct {
+	kvStore
+	lock *FileLock
+}
+
+func (kv *lockedKV) Close() error {
+	defer kv.lock.Unlock()
+	return kv.kvStore.Close()
+}
+
+func (kv *lockedKV) Abort() {
+	kv.kvStore.Abort()
+	kv.lock.Unlock()
+}
+
+// lock locks the database for writing (exclusive lock) or reading
+// (shared lock).
+func (s *kvTokenStore) lock(write bool) (*FileLock, error) {
+	return LockFile(s.lockfile, !write)
+}
+
+// openLocked locks the database and opens it.
+func (s *kvTokenStore) openLocked(write bool) (kvStore, error) {
+	lock, err := s.lock(write)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := s.backend.Open(write)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return &lockedKV{kvStore: kv, lock: lock}, nil
+}
+
+// open opens the database and returns the codec for its values.  If the
+// database is opened for writing and a secret is configured, plaintext
+// database is encrypted first.
+func (s *kvTokenStore) open(write bool) (kvStore, *tokenCodec, error) {
+	kv, err := s.openLocked(write)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := TokenSecret()
+	if err != nil {
+		kv.Abort()
+		return nil, nil, err
+	}
+	codec, err := tokenCodecFor(kv, secret)
+	if err != nil {
+		kv.Abort()
+		return nil, nil, err
+	}
+	if codec.aead == nil && secret != nil && write {
+		if codec, err = encryptTokenDB(kv, secret); err != nil {
+			kv.Abort()
+			return nil, nil, fmt.Errorf("can't encrypt token database: %v", err)
+		}
+	}
+	return kv, codec, nil
+}
+
+func (s *kvTokenStore) Fetch(key string) (GHToken, error) {
+	var tok GHToken
+	kv, codec, err := s.open(false)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = ErrTokenNotFound
+		}
+		return tok, err
+	}
+	defer kv.Close()
+	js, err := kv.Get(key)
+	if err == nil {
+		if js, err = codec.Decode(key, js); err == nil {
+			err = json.Unmarshal(js, &tok)
+		}
+	}
+	return tok, err
+}
+
+func (s *kvTokenStore) Store(key string, token GHToken) error {
+	js, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	kv, codec, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	if js, err = codec.Encode(key, js); err != nil {
+		kv.Abort()
+		return fmt.Errorf("can't encrypt key %s: %v", key, err)
+	}
+	if err := kv.Put(key, js); err != nil {
+		kv.Abort()
+		return fmt.Errorf("can't store key %s: %v", key, err)
+	}
+	return kv.Close()
+}
+
+func (s *kvTokenStore) Delete(key string) error {
+	kv, _, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	if err := kv.Delete(key); err != nil {
+		kv.Abort()
+		return err
+	}
+	return kv.Close()
+}
+
+func (s *kvTokenStore) List(prefix string) ([]string, error) {
+	kv, err := s.openLocked(false)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer kv.Close()
+	keys, err := kvTokenKeys(kv)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Returns all token keys from the database, i.e. all keys except the
+// encryption record.
+func kvTokenKeys(kv kvStore) ([]string, error) {
+	keys, err := kv.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, key := range keys {
+		if key != tokenCryptMetaKey {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,108 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ----------------------------------
+// Environment token store
+// ----------------------------------
+
+// The environment store is read-only.  The token for the key is taken
+// from the environment variable named by EnvTokenVariable, e.g.
+// GHB_TOKEN_ORGS_EXAMPLEORG for "/orgs/ExampleOrg" or
+// GHB_TOKEN_GHE_EXAMPLE_COM_ORGS_EXAMPLEORG for "ghe.example.com/orgs/ExampleOrg".  Its expiration time
+// is taken from the variable with the same name suffixed with _EXPIRES,
+// in RFC 3339 format.  If it is not set, the token never expires.
+// Tokens obtained from GitHub (registration tokens, etc.) are not cached.
+
+const (
+	envTokenPrefix = `GHB_TOKEN`
+	envTokenExpiresSuffix = `_EXPIRES`
+)
+
+func init() {
+	RegisterTokenStore(`env`, func() (TokenStore, error) {
+		return envTokenStore{}, nil
+	})
+}
+
+// EnvTokenVariable returns the name of the environment variable keeping
+// the token for the key.
+func EnvTokenVariable(key string) string {
+	if !strings.HasPrefix(key, `/`) {
+		// Key with host prefix
+		key = `/` + key
+	}
+	return envTokenPrefix + strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+}
+
+type envTokenStore struct {}
+
+func (envTokenStore) Fetch(key string) (tok GHToken, err error) {
+	name := EnvTokenVariable(key)
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		err = ErrTokenNotFound
+		return
+	}
+	tok.Token = value
+	tok.ExpiresAt = NoExpiration
+	if exp := os.Getenv(name + envTokenExpiresSuffix); exp != "" {
+		if tok.ExpiresAt, err = time.Parse(time.RFC3339, exp); err != nil {
+			err = fmt.Errorf("%s: %v", name + envTokenExpiresSuffix, err)
+		}
+	}
+	return
+}
+
+func (envTokenStore) Store(key string, token GHToken) error {
+	return ErrTokenStoreReadOnly
+}
+
+func (envTokenStore) Delete(key string) error {
+	return ErrTokenStoreReadOnly
+}
+
+// List returns PAT keys of the entities that have runners and for which
+// the token variable is set.  Variable names can't be converted back to
+// keys, so this is the best approximation.
+func (s envTokenStore) List(prefix string) ([]string, error) {
+	pc, err := ParsePiesConfig(config.PiesConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for key := range pc.Runners {
+		ent, err := ParseEntityKey(key)
+		if err != nil {
+			continue
+		}
+		patkey := ent.PATKey()
+		if seen[patkey] || !strings.HasPrefix(patkey, prefix) {
+			continue
+		}
+		seen[patkey] = true
+		if _, err := s.Fetch(patkey); err == nil {
+			keys = append(keys, patkey)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,101 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"io/ioutil"
+	"encoding/json"
+	"path/filepath"
+)
+
+// ----------------------------------
+// File token store
+// ----------------------------------
+
+// The file store keeps tokens in a JSON file in the cache directory.
+// It doesn't need cgo.
+
+func init() {
+	RegisterTokenStore(`file`, func() (TokenStore, error) {
+		filename := filepath.Join(config.CacheDir, `token.json`)
+		return &kvTokenStore{backend: fileBackend{filename}, lockfile: filename + `.lock`}, nil
+	})
+}
+
+type fileBackend struct {
+	filename string
+}
+
+type fileKV struct {
+	filename string
+	values map[string][]byte
+	modified bool
+}
+
+func (b fileBackend) Open(write bool) (kvStore, error) {
+	kv := &fileKV{filename: b.filename, values: make(map[string][]byte)}
+	js, err := ioutil.ReadFile(b.filename)
+	if err != nil {
+		if os.IsNotExist(err) && write {
+			return kv, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(js, &kv.values); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.filename, err)
+	}
+	return kv, nil
+}
+
+func (b fileBackend) Create() (kvStore, error) {
+	return &fileKV{filename: b.filename, values: make(map[string][]byte), modified: true}, nil
+}
+
+func (kv *fileKV) Get(key string) ([]byte, error) {
+	if value, ok := kv.values[key]; ok {
+		return value, nil
+	}
+	return nil, ErrTokenNotFound
+}
+
+func (kv *fileKV) Put(key string, value []byte) error {
+	kv.values[key] = value
+	kv.modified = true
+	return nil
+}
+
+func (kv *fileKV) Delete(key string) error {
+	if _, ok := kv.values[key]; !ok {
+		return ErrTokenNotFound
+	}
+	delete(kv.values, key)
+	kv.modified = true
+	return nil
+}
+
+func (kv *fileKV) Keys() ([]string, error) {
+	var keys []string
+	for key := range kv.values {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (kv *fileKV) Close() error {
+	if !kv.modified {
+		return nil
+	}
+	js, err := json.MarshalIndent(kv.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(kv.filename, js, 0600)
+}
+
+func (kv *fileKV) Abort() {
+}
@@ -0,0 +1,120 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+//go:build cgo
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"errors"
+	"path/filepath"
+	"github.com/graygnuorg/go-gdbm"
+)
+
+// ----------------------------------
+// GDBM token store
+// ----------------------------------
+
+func init() {
+	RegisterTokenStore(`gdbm`, func() (TokenStore, error) {
+		filename := filepath.Join(config.CacheDir, `token.db`)
+		return &kvTokenStore{backend: gdbmBackend{filename}, lockfile: filename + `.lock`}, nil
+	})
+}
+
+type gdbmBackend struct {
+	filename string
+}
+
+type gdbmKV struct {
+	db *gdbm.Database
+	// For databases returned by Create: temporary file name to be
+	// renamed to filename on Close.
+	tempname string
+	filename string
+}
+
+func (b gdbmBackend) Open(write bool) (kvStore, error) {
+	mode := gdbm.ModeReader
+	if write {
+		mode = gdbm.ModeWrcreat
+	}
+	db, err := gdbm.Open(b.filename, mode)
+	if err != nil {
+		if write {
+			return nil, fmt.Errorf("can't open database file %s for update: %w", b.filename, err)
+		}
+		return nil, fmt.Errorf("can't open database file %s: %w", b.filename, err)
+	}
+	return &gdbmKV{db: db, filename: b.filename}, nil
+}
+
+func (b gdbmBackend) Create() (kvStore, error) {
+	tempname := b.filename + `.new`
+	os.Remove(tempname)
+	db, err := gdbm.OpenConfig(gdbm.DatabaseConfig{
+		FileName: tempname,
+		Mode: gdbm.ModeNewdb,
+		FileMode: 0600,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't create %s: %v", tempname, err)
+	}
+	return &gdbmKV{db: db, tempname: tempname, filename: b.filename}, nil
+}
+
+func (kv *gdbmKV) Get(key string) ([]byte, error) {
+	value, err := kv.db.Fetch([]byte(key))
+	if errors.Is(err, gdbm.ErrItemNotFound) {
+		err = ErrTokenNotFound
+	}
+	return value, err
+}
+
+func (kv *gdbmKV) Put(key string, value []byte) error {
+	return kv.db.Store([]byte(key), value, true)
+}
+
+func (kv *gdbmKV) Delete(key string) error {
+	return kv.db.Delete([]byte(key))
+}
+
+func (kv *gdbmKV) Keys() ([]string, error) {
+	var keys []string
+	next := kv.db.Iterator()
+	for {
+		b, err := next()
+		if err != nil {
+			if errors.Is(err, gdbm.ErrItemNotFound) {
+				break
+			}
+			return nil, err
+		}
+		keys = append(keys, string(b))
+	}
+	return keys, nil
+}
+
+func (kv *gdbmKV) Close() error {
+	if err := kv.db.Close(); err != nil {
+		return err
+	}
+	if kv.tempname != "" {
+		if err := os.Rename(kv.tempname, kv.filename); err != nil {
+			os.Remove(kv.tempname)
+			return fmt.Errorf("can't rename %s to %s: %v", kv.tempname, kv.filename, err)
+		}
+	}
+	return nil
+}
+
+func (kv *gdbmKV) Abort() {
+	kv.db.Close()
+	if kv.tempname != "" {
+		os.Remove(kv.tempname)
+	}
+}
@@ -0,0 +1,134 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"fmt"
+	"time"
+	"sort"
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// ----------------------------------
+// Credential helper token store
+// ----------------------------------
+
+// The helper store delegates token storage to an external program, in
+// the manner of git credential helpers.  The program, given by the
+// token_helper setting, is run by the shell with the operation name (get,
+// store, erase or list) as its argument.  It reads attributes in the form
+// NAME=VALUE, one per line, from its standard input, until an empty line
+// or end of file:
+//
+//   get    key=KEY
+//          Prints token=TOKEN and, optionally, expires_at=TIME (RFC 3339)
+//          to standard output.  Empty output means the token is not found.
+//   store  key=KEY, token=TOKEN, expires_at=TIME
+//   erase  key=KEY
+//   list   prefix=PREFIX
+//          Prints key=KEY for each stored key starting with PREFIX.
+//
+// Non-zero exit status indicates an error.
+
+func init() {
+	RegisterTokenStore(`helper`, func() (TokenStore, error) {
+		if config.TokenHelper == "" {
+			return nil, errors.New("token_store is helper, but token_helper is not set")
+		}
+		return helperTokenStore{config.TokenHelper}, nil
+	})
+}
+
+type helperTokenStore struct {
+	command string
+}
+
+// Runs the helper and returns the attributes it printed.  Multiple
+// values of the same attribute are returned in order.
+func (s helperTokenStore) run(op string, attrs [][2]string) (map[string][]string, error) {
+	var input bytes.Buffer
+	for _, a := range attrs {
+		if strings.ContainsAny(a[1], "\r\n") {
+			return nil, fmt.Errorf("%s: value can't contain newlines", a[0])
+		}
+		fmt.Fprintf(&input, "%s=%s\n", a[0], a[1])
+	}
+	input.WriteString("\n")
+
+	cmd := exec.Command("/bin/sh", "-c", s.command + ` "$@"`, s.command, op)
+	cmd.Stdin = &input
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("token helper %s failed: %v", op, err)
+	}
+
+	result := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, `=`, 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("token helper %s: malformed output line %q", op, line)
+		}
+		result[kv[0]] = append(result[kv[0]], kv[1])
+	}
+	return result, scanner.Err()
+}
+
+func (s helperTokenStore) Fetch(key string) (tok GHToken, err error) {
+	var attrs map[string][]string
+	if attrs, err = s.run(`get`, [][2]string{{`key`, key}}); err != nil {
+		return
+	}
+	if len(attrs[`token`]) == 0 || attrs[`token`][0] == "" {
+		err = ErrTokenNotFound
+		return
+	}
+	tok.Token = attrs[`token`][0]
+	tok.ExpiresAt = NoExpiration
+	if exp := attrs[`expires_at`]; len(exp) > 0 {
+		tok.ExpiresAt, err = time.Parse(time.RFC3339, exp[0])
+	}
+	return
+}
+
+func (s helperTokenStore) Store(key string, token GHToken) error {
+	_, err := s.run(`store`, [][2]string{
+		{`key`, key},
+		{`token`, token.Token},
+		{`expires_at`, token.ExpiresAt.Format(time.RFC3339)},
+	})
+	return err
+}
+
+func (s helperTokenStore) Delete(key string) error {
+	_, err := s.run(`erase`, [][2]string{{`key`, key}})
+	return err
+}
+
+func (s helperTokenStore) List(prefix string) ([]string, error) {
+	attrs, err := s.run(`list`, [][2]string{{`prefix`, prefix}})
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, key := range attrs[`key`] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,205 @@
+// THE BEER-WARE LICENSE" (Revision 42):
+// <gray@gnu.org> wrote this file.  As long as you retain this notice you
+// can do whatever you want with this stuff. If we meet some day, and you
+// think this stuff is worth it, you can buy me a beer in return.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"fmt"
+	"log"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"strconv"
+	"path/filepath"
+)
+
+// ----------------------------------
+// Runner software upgrade
+// ----------------------------------
+
+// RunnerVersion returns the version of the runner installed in dirname.
+func RunnerVersion(dirname string) (string, error) {
+	out, err := exec.Command(filepath.Join(dirname, `bin`, `Runner.Listener`), `--version`).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// UpgradeRunner replaces the runner software in dirname with the one
+// from the archive arc.  The archive is first extracted into a temporary
+// subdirectory, so that a failed extraction leaves the existing software
+// intact.  Its contents are then moved in place, replacing the old files
+// and directories (bin, externals, etc.).  Everything else (.runner,
+// .credentials, .env, _work, etc.) is preserved.
+func UpgradeRunner(arc, dirname string) error {
+	tmpdir, err := ioutil.TempDir(dirname, `.ghb-upgrade-`)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	newdir := filepath.Join(tmpdir, `new`)
+	if err := ExtractRunner(arc, newdir, os.Stdout); err != nil {
+		return err
+	}
+	olddir := filepath.Join(tmpdir, `old`)
+	if err := os.Mkdir(olddir, 0750); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(newdir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		target := filepath.Join(dirname, e.Name())
+		// Directories can't be renamed over: move the old one out
+		// of the way first, to get rid of stale files.
+		if st, err := os.Lstat(target); err == nil && st.IsDir() {
+			if err := os.Rename(target, filepath.Join(olddir, e.Name())); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(filepath.Join(newdir, e.Name()), target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func UpgradeAction(args []string) {
+	ReadConfig()
+	FinalizeConfig()
+	optset := NewEntityOptset(args)
+	optset.SetParameters("")
+	force := false
+	optset.FlagLong(&force, "force", 'f', "Upgrade runners even if they are up to date")
+	// Entity is optional: don't call optset.Parse
+	optset.Optset.Parse()
+
+	if len(optset.Args()) != 0 {
+		log.Fatalf("too many arguments; try `%s --help' for assistance", optset.Command)
+	}
+
+	lock, err := LockRoot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	pc, err := ParsePiesConfig(config.PiesConfigFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var keys []string
+	if optset.Entity.Name != "" {
+		keys = append(keys, optset.Entity.BaseKey())
+		if _, ok := pc.Runners[keys[0]]; !ok {
+			log.Fatalf("found no runners for %s", keys[0])
+		}
+	} else {
+		for key := range pc.Runners {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	failed := 0
+	for _, key := range keys {
+		ent, err := ParseEntityKey(key)
+		if err != nil {
+			log.Print(err)
+			failed++
+			continue
+		}
+
+		arcfile, err := GetRunnerArchive(ent)
+		if err != nil {
+			log.Printf("%s: %v", key, err)
+			failed++
+			continue
+		}
+		version := ""
+		if arc, err := ParseArchiveName(filepath.Base(arcfile)); err == nil {
+			version = arc.Version
+		}
+
+		pat, err := GetToken(ent.PATKey())
+		if err != nil {
+			log.Printf("%s: %v", key, err)
+			failed++
+			continue
+		}
+		for _, r := range pc.Runners[key] {
+			runnerName := filepath.Join(key, strconv.Itoa(r.Num))
+			if !force && version != "" {
+				if v, err := RunnerVersion(r.Dir); err == nil && v == version {
+					fmt.Printf("%s: up to date (%s)\n", runnerName, v)
+					continue
+				}
+			}
+
+			name, err := RegisteredRunnerName(r.Dir, runnerName)
+			if err != nil {
+				log.Printf("%s: %v", runnerName, err)
+				failed++
+				continue
+			}
+
+			status, err := GetPiesComponentStatus(pc.ControlURL, runnerName)
+			if err != nil {
+				log.Printf("%s: can't get component status: %v", runnerName, err)
+				failed++
+				continue
+			}
+			running := status == `running`
+
+			// Check the busy state right before stopping the
+			// runner: previous upgrades may have taken a while.
+			if ghr, err := GitHubFindRunner(ent, pat, name); err != nil {
+				log.Printf("%s: %v", runnerName, err)
+				failed++
+				continue
+			} else if ghr != nil && ghr.Busy {
+				fmt.Printf("%s: busy, skipping\n", runnerName)
+				continue
+			}
+
+			fmt.Printf("%s: upgrading to %s\n", runnerName, version)
+			if running {
+				if err := PiesStopComponent(pc.ControlURL, runnerName); err != nil {
+					log.Printf("%s: can't stop: %v", runnerName, err)
+					failed++
+					continue
+				}
+			}
+			if err := UpgradeRunner(arcfile, r.Dir); err != nil {
+				// Don't restart a broken installation: pies
+				// would respawn it over and over.
+				if running {
+					log.Printf("%s: %v; component left stopped", runnerName, err)
+				} else {
+					log.Printf("%s: %v", runnerName, err)
+				}
+				failed++
+				continue
+			}
+			if running {
+				if err := PiesStartComponent(pc.ControlURL, runnerName); err != nil {
+					log.Printf("%s: can't start: %v", runnerName, err)
+					failed++
+				}
+			}
+		}
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}